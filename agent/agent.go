@@ -3,27 +3,33 @@ package agent
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/easzlab/ezvpn/config"
-	"github.com/gorilla/websocket"
+	"github.com/easzlab/ezvpn/control"
+	"github.com/easzlab/ezvpn/logging"
+	"github.com/easzlab/ezvpn/pki"
+	"github.com/easzlab/ezvpn/relay"
+	"github.com/easzlab/ezvpn/socks"
+	"github.com/easzlab/ezvpn/transport"
 	"github.com/panjf2000/ants/v2"
 )
 
-// dialer is the websocket dialer used to connect to a gateway server.
-var dialer = websocket.DefaultDialer
-
 // Agent tunnels remote port on a gateway server to local destination.
 type Agent struct {
-	AuthKey       string
+	AuthKey string
+	// Name is the name of the agent in the allowed agents of the server,
+	// needed when several of them match the agent certificate.
+	Name          string
 	ServerAddress string
 	EnableTLS     bool
 	EnablePprof   bool
@@ -31,10 +37,38 @@ type Agent struct {
 	CertFile      string
 	KeyFile       string
 	LocalAddress  string
+	// ServerName is the name the server certificate is verified for, and
+	// sent as SNI, when it differs from the host of ServerAddress.
+	ServerName string
+	// PinSHA256 are the accepted SHA-256 hashes of the server public key.
+	PinSHA256 []string
+	// DrainTimeout is how long live sessions are waited for on shutdown.
+	DrainTimeout time.Duration
+	// Compression asks the server for permessage-deflate on sessions.
+	Compression bool
+	// Transport is the transport to the server, `websocket`, `mux` or `quic`.
+	Transport string
+
+	// certs holds the client certificate and the trusted CAs, reloaded when
+	// the files change.
+	certs *pki.Reloader
+
+	// ticket is the latest session ticket sent by the server.
+	mu      sync.Mutex
+	ticket  string
+	expires time.Time
+
+	// sessions tracks the live sessions, which are killed by canceling
+	// sessionCtx once they are not drained in time.
+	sessions     sync.WaitGroup
+	sessionCtx   context.Context
+	killSessions context.CancelFunc
 }
 
-// wg and ants.Pool is used to manage goroutines.
-var wg sync.WaitGroup
+// logger is the logger of the agent component.
+var logger = logging.Component(logging.Agent)
+
+// ants.Pool is used to manage goroutines.
 var pool *ants.Pool
 
 // init initializes ants.Pool.
@@ -42,34 +76,25 @@ func init() {
 	var err error
 	pool, err = ants.NewPool(config.GoroutinePoolSize)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("failed to create the goroutine pool", "error", err)
+		os.Exit(1)
 	}
 }
 
-// Start starts
+// Start registers the agent and tunnels local connections until ctx is
+// canceled. Live sessions are then drained, see drain.
 func (agent *Agent) Start(ctx context.Context) error {
-	if agent.EnableTLS {
-		cert, err := os.ReadFile(agent.CaFile)
-		if err != nil {
-			log.Fatalf("could not open certificate file: %v", err)
-		}
-
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(cert)
+	agent.sessionCtx, agent.killSessions = context.WithCancel(context.Background())
+	defer agent.killSessions()
 
-		certificate, err := tls.LoadX509KeyPair(agent.CertFile, agent.KeyFile)
+	if agent.EnableTLS {
+		certs, err := pki.NewReloader(agent.CertFile, agent.KeyFile, agent.CaFile)
 		if err != nil {
-			log.Fatalf("could not load certificate: %v", err)
-		}
-
-		dialer.TLSClientConfig = &tls.Config{
-			MinVersion:               tls.VersionTLS13,
-			RootCAs:                  caCertPool,
-			PreferServerCipherSuites: true,
-			Certificates:             []tls.Certificate{certificate},
+			logger.Error("could not load certificate", "error", err)
+			os.Exit(1)
 		}
+		agent.certs = certs
 	}
-	dialer.HandshakeTimeout = config.WsHandshakeTimeout
 
 	errCh := make(chan error)
 
@@ -79,18 +104,89 @@ func (agent *Agent) Start(ctx context.Context) error {
 		defer retry.Stop()
 		for {
 			err := agent.register(ctx)
+			if errors.Is(err, errGoingAway) {
+				continue
+			}
 			if err == nil || !isRecoverable(err) {
 				c <- err
 				return
 			}
-			log.Printf("Agent error %q - recovering...", err)
-			<-retry.C
+			logger.Warn("agent error, recovering", "error", err)
+			select {
+			case <-retry.C:
+			case <-ctx.Done():
+				c <- ctx.Err()
+				return
+			}
 		}
 	})(errCh)
 
-	return <-errCh
+	err := <-errCh
+	// sessions outlive a lost control channel, drain them as well
+	agent.drain()
+	return err
+}
+
+// drain waits up to DrainTimeout for the live sessions to finish, then kills
+// the remaining ones, which are closed with normal close frames.
+func (agent *Agent) drain() {
+	done := make(chan struct{})
+	go func() {
+		agent.sessions.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(agent.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	logger.Warn("drain timeout reached, closing the remaining sessions")
+	agent.killSessions()
+	<-done
+}
+
+// CheckTransport returns an error if the transport is unknown or does not
+// support the other settings of the agent.
+func (agent *Agent) CheckTransport() error {
+	switch agent.Transport {
+	case "websocket":
+	case "mux", "quic":
+		if !agent.EnableTLS {
+			return fmt.Errorf("the %s transport requires tls", agent.Transport)
+		}
+	default:
+		return fmt.Errorf("unknown transport %s", agent.Transport)
+	}
+	// only websocket sessions negotiate compression
+	if agent.Compression && agent.Transport != "websocket" {
+		return fmt.Errorf("the %s transport does not support compression", agent.Transport)
+	}
+	return nil
+}
+
+// transport returns the transport connecting the agent to the server.
+func (agent *Agent) transport() transport.Transport {
+	var tlsConfig func() *tls.Config
+	if agent.EnableTLS {
+		tlsConfig = agent.clientTLSConfig
+	}
+	switch agent.Transport {
+	case "mux":
+		return &transport.Mux{Address: agent.ServerAddress, TLSConfig: tlsConfig}
+	case "quic":
+		return &transport.QUIC{Address: agent.ServerAddress, TLSConfig: tlsConfig}
+	}
+	return &transport.WebSocket{Address: agent.ServerAddress, TLSConfig: tlsConfig, Compression: agent.Compression}
 }
 
+// errGoingAway is returned by register once the server is going away, the
+// agent registers again right away.
+var errGoingAway = errors.New("server is going away")
+
 // Returns true if agent error is recoverable (by restarting agent).
 func isRecoverable(err error) bool {
 	return !errors.Is(err, context.Canceled)
@@ -118,28 +214,22 @@ func hookCancel(ctx context.Context, handler func()) func() {
 func (agent *Agent) register(ctx context.Context) error {
 
 	// 1.Connection to the ezvpn server.
-	var url string
-	if agent.EnableTLS {
-		url = "wss://" + agent.ServerAddress + "/register/" + agent.AuthKey
-	} else {
-		url = "ws://" + agent.ServerAddress + "/register/" + agent.AuthKey
-	}
-
-	header := http.Header{}
+	header := agent.header(false)
 	header.Add("Agent", "ezvpn-agent@easzlab")
-	ws, resp, err := dialer.DialContext(ctx, url, header)
+	ctrl, err := agent.transport().Dial(ctx, header)
 	if err != nil {
-		if err == websocket.ErrBadHandshake {
-			log.Printf("handshake failed with status %d", resp.StatusCode)
+		var rejected *transport.RejectError
+		if errors.As(err, &rejected) {
+			logger.Warn("handshake failed", "status", rejected.Status, "error", rejected.Reason)
 		}
 		return err
 	}
-	defer closeWebsocket(ws)
-
-	unhookCancel := hookCancel(ctx, func() {
-		closeWebsocket(ws)
-	})
-	defer unhookCancel()
+	closeCtrl := true
+	defer func() {
+		if closeCtrl {
+			ctrl.Close()
+		}
+	}()
 
 	// 2. Listen on local port.
 	ln, err := net.Listen("tcp", agent.LocalAddress)
@@ -148,111 +238,182 @@ func (agent *Agent) register(ctx context.Context) error {
 	}
 	defer ln.Close()
 
-	log.Printf("Listening on: %s", agent.LocalAddress)
+	// stop accepting once canceled, the control channel is kept open until
+	// the sessions bound to it are drained
+	unhookCancel := hookCancel(ctx, func() {
+		ln.Close()
+	})
+	defer unhookCancel()
 
-	// Forcifully close connection if the server does not respond to ping.
-	go Watch(ws, config.WsKeepliveInterval, ln.Close)
+	logger.Info("listening", "address", agent.LocalAddress)
 
+	// Forcifully close connection if the server does not respond to ping.
 	go func() {
-		for {
-			// Server does not send message to this channel in the current
-			// protocol, but it is required to drain the channel to check
-			// for ping responses.
-			if _, _, err := ws.NextReader(); err != nil {
-				break
-			}
-		}
+		ctrl.Keepalive(config.WsKeepliveInterval)
+		ln.Close()
 	}()
 
+	// Read control messages, this is also required to receive the responses
+	// checked by Keepalive. A server going away, e.g. handing over to a new
+	// process, stops the accepting.
+	var away atomic.Bool
+	go agent.readControl(ctrl, func() {
+		away.Store(true)
+		ln.Close()
+	})
+
+	// sessions are the sessions bound to ctrl
+	var sessions sync.WaitGroup
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				logger.Info("stopped accepting, draining sessions", "timeout", agent.DrainTimeout)
+				agent.drain()
+				return ctx.Err()
+			}
+			if away.Load() {
+				// ctrl is kept open until its sessions are done, the
+				// server closes it after draining them at the latest
+				closeCtrl = false
+				go func() {
+					sessions.Wait()
+					ctrl.Close()
+				}()
+				return errGoingAway
+			}
 			return err
 		}
 
+		agent.sessions.Add(1)
+		sessions.Add(1)
 		go func() {
-			if err := agent.tunnel(conn, ctx); err != nil {
-				log.Printf("Tunneling error: %s", err)
+			defer agent.sessions.Done()
+			defer sessions.Done()
+			if err := agent.tunnel(ctrl, conn, agent.sessionCtx); err != nil {
+				logger.Warn("tunneling failed", "remote", conn.RemoteAddr().String(), "error", err)
 			}
 		}()
 	}
 }
 
-// tunnel proxies a local connection(socks protocol) to a remote server via websocket.
-// The tunnel can be canceled via context, it looks like this:
-// (socks client) <--conn--> Agent <--ws--> Server <--conn--> (socks server) <--> Destination
-func (agent *Agent) tunnel(conn net.Conn, ctx context.Context) error {
-	log.Printf("Tunneling local connection from %s", conn.RemoteAddr())
+// readControl reads control messages sent by the server until ctrl is closed,
+// goingAway is called once the server tells it is going away. The tickets of
+// ctrl are not used from then on, the next control channel has its own.
+func (agent *Agent) readControl(ctrl transport.ClientConn, goingAway func()) {
+	away := false
+	defer func() {
+		if !away {
+			agent.setTicket("", time.Time{})
+		}
+	}()
 
-	// Remote connection proxied through WebSocket.
-	var url string
-	if agent.EnableTLS {
-		url = "wss://" + agent.ServerAddress + "/session/" + agent.AuthKey
+	for {
+		data, err := ctrl.ReadMessage()
+		if err != nil {
+			var closed *transport.CloseError
+			if errors.As(err, &closed) && closed.Reason != "" {
+				logger.Warn("control channel closed by the server", "reason", closed.Reason)
+			}
+			return
+		}
+
+		var msg control.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			logger.Warn("invalid control message", "error", err)
+			continue
+		}
+
+		switch msg.Type {
+		case control.TypeTicket:
+			if !away {
+				agent.setTicket(msg.Ticket, msg.Expires)
+			}
+		case control.TypeShutdown:
+			if !away {
+				logger.Warn("server is going away, registering again", "reason", msg.Reason)
+				agent.setTicket("", time.Time{})
+				away = true
+				goingAway()
+			}
+		}
+	}
+}
+
+// setTicket stores the session ticket to use for new sessions.
+func (agent *Agent) setTicket(ticket string, expires time.Time) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	agent.ticket, agent.expires = ticket, expires
+}
+
+// header returns the request header carrying the agent's credential, which is
+// kept out of the URL so that it does not show up in access logs. Sessions
+// use the short-lived ticket from the server when one is available.
+func (agent *Agent) header(session bool) http.Header {
+	header := http.Header{}
+
+	agent.mu.Lock()
+	ticket, expires := agent.ticket, agent.expires
+	agent.mu.Unlock()
+
+	if session && ticket != "" && time.Now().Before(expires) {
+		header.Set("Authorization", "Ticket "+ticket)
 	} else {
-		url = "ws://" + agent.ServerAddress + "/session/" + agent.AuthKey
+		header.Set("Authorization", "Bearer "+agent.AuthKey)
+		if agent.Name != "" {
+			header.Set(control.HeaderAgentName, agent.Name)
+		}
 	}
-	ws, _, err := dialer.DialContext(ctx, url, nil)
+	return header
+}
+
+// tunnel proxies a local connection(socks protocol) to a remote server via a
+// session opened next to the control channel ctrl.
+// The tunnel can be canceled via context, it looks like this:
+// (socks client) <--conn--> Agent <--stream--> Server <--conn--> (socks server) <--> Destination
+func (agent *Agent) tunnel(ctrl transport.ClientConn, conn net.Conn, ctx context.Context) error {
+	log := logger.With("remote", conn.RemoteAddr().String())
+	log.Debug("tunneling local connection")
+
+	stream, err := ctrl.Open(ctx, agent.header(true))
 	if err != nil {
+		// the client gets a general failure instead of a dropped connection
+		go (&socks.Server{}).Refuse(conn)
+		var rejected *transport.RejectError
+		if errors.As(err, &rejected) {
+			return fmt.Errorf("session %w", err)
+		}
 		return err
 	}
-	defer closeWebsocket(ws)
+	defer stream.Close()
+
+	log = log.With("session_id", stream.SessionID())
+	log.Info("session established", "compression", stream.Compressed())
 
 	unhookCancel := hookCancel(ctx, func() {
 		conn.Close()
-		closeWebsocket(ws)
+		stream.Close()
 	})
 	defer unhookCancel()
 
 	errCh := make(chan error, 2)
 
-	// uplink: (socks client) --conn--> Agent --ws--> Server
+	// uplink: (socks client) --conn--> Agent --stream--> Server
 	uplink := func() {
 		func(c chan error) {
-			buf := make([]byte, config.BufferSize)
-
-			for {
-				n, err := conn.Read(buf)
-				if err != nil {
-					c <- err
-					return
-				}
-
-				if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-					c <- err
-					return
-				}
-			}
+			c <- relay.Send(stream, conn, nil)
 		}(errCh)
-
-		wg.Done()
 	}
 
-	// Downlink: (socks client) <--conn-- Agent <--ws-- Server
+	// Downlink: (socks client) <--conn-- Agent <--stream-- Server
 	downlink := func() {
 		func(c chan error) {
-			buf := make([]byte, config.BufferSize)
-
-			for {
-				_, r, err := ws.NextReader()
-				if err != nil {
-					c <- err
-					return
-				}
-
-				if _, err := io.CopyBuffer(conn, r, buf); err != nil {
-					c <- err
-					return
-				}
-			}
+			c <- relay.Receive(stream, conn, nil)
 		}(errCh)
-
-		wg.Done()
 	}
 
-	wg.Add(1)
 	pool.Submit(uplink)
-
-	wg.Add(1)
 	pool.Submit(downlink)
 
 	// wait for uplink and downlink to finish or emit error
@@ -260,21 +421,21 @@ func (agent *Agent) tunnel(conn net.Conn, ctx context.Context) error {
 		err := <-errCh
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				log.Printf("Client %s closed normally. Closing session.", conn.RemoteAddr())
+				log.Info("client closed, finishing session")
 				return nil
 			}
 
 			if errors.Is(err, net.ErrClosed) {
-				log.Printf("Canceled. Finishing session from %s", conn.RemoteAddr())
+				log.Info("canceled, finishing session")
 				return nil
 			}
 
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				log.Printf("Session closed normally. Closing client %s.", conn.RemoteAddr())
+			if errors.Is(err, transport.ErrClosed) {
+				log.Info("session closed, finishing session")
 				return nil
 			}
 
-			log.Printf("Error %q. Killing session %s.", err, conn.RemoteAddr())
+			log.Warn("killing session", "error", err)
 
 			return err
 		}
@@ -282,45 +443,3 @@ func (agent *Agent) tunnel(conn net.Conn, ctx context.Context) error {
 
 	return nil
 }
-
-// closeWebsocket attempts to close a websocket session normally. It is ok to
-// call this function on a connection that has already been closed by the peer.
-func closeWebsocket(ws *websocket.Conn) {
-	ws.WriteControl(
-		websocket.CloseMessage,
-		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
-		time.Now().Add(config.WsCloseTimeout),
-	)
-	ws.Close()
-}
-
-// Watch watches for broken WebSocket connection. This function periodically
-// sends ping message to the websocket peer and invokes `handler` on first
-// timeout. The caller must continuously read something from `ws` to allow
-// pong messages to be received.
-func Watch(ws *websocket.Conn, timeout time.Duration, handler func() error) error {
-	ticker := time.NewTicker(timeout)
-	defer ticker.Stop()
-
-	pong := make(chan bool)
-	ws.SetPongHandler(func(_ string) error {
-		pong <- true
-		return nil
-	})
-
-	for tick := range ticker.C {
-		if err := ws.WriteControl(websocket.PingMessage, []byte(""), tick.Add(timeout)); err != nil {
-			break
-		}
-
-		select {
-		case <-pong:
-			continue
-
-		case <-ticker.C:
-		}
-		break
-	}
-
-	return handler()
-}
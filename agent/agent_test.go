@@ -0,0 +1,32 @@
+package agent
+
+import "testing"
+
+func TestCheckTransport(t *testing.T) {
+	tests := []struct {
+		transport   string
+		tls         bool
+		compression bool
+		wantErr     bool
+	}{
+		{"websocket", true, false, false},
+		{"websocket", false, false, false},
+		{"websocket", true, true, false},
+		{"mux", true, false, false},
+		// the mux port always asks for the agent certificate
+		{"mux", false, false, true},
+		// only websocket sessions negotiate compression
+		{"mux", true, true, true},
+		{"quic", true, false, false},
+		{"quic", false, false, true},
+		{"quic", true, true, true},
+		{"tcp", true, false, true},
+	}
+
+	for _, tt := range tests {
+		a := &Agent{Transport: tt.transport, EnableTLS: tt.tls, Compression: tt.compression}
+		if err := a.CheckTransport(); (err != nil) != tt.wantErr {
+			t.Errorf("CheckTransport(%s, tls %v, compression %v) = %v, want error %v", tt.transport, tt.tls, tt.compression, err, tt.wantErr)
+		}
+	}
+}
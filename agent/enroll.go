@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/control"
+)
+
+// File names written by Enroll.
+const (
+	CertFile    = "agent.pem"
+	KeyFile     = "agent-key.pem"
+	CAFile      = "ca.pem"
+	AuthKeyFile = "auth-key"
+)
+
+// Enroll enrolls a new agent with a single-use bootstrap token. The private
+// key is generated locally and never leaves the machine: only a CSR is sent,
+// and the signed certificate, the CA bundle and the auth key are written to
+// dir. The server is verified with CaFile when set, the system roots
+// otherwise.
+func (agent *Agent) Enroll(token, dir string) (*control.EnrollResponse, error) {
+	// the token is redeemed by the server, make sure the files can be
+	// written before using it
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "ezvpn-agent"},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	body, _ := json.Marshal(control.EnrollRequest{
+		Token: token,
+		CSR:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+
+	client := &http.Client{Timeout: config.WsHandshakeTimeout}
+	url := "http://" + agent.ServerAddress + "/enroll"
+	if agent.EnableTLS {
+		var roots *x509.CertPool
+		if agent.CaFile != "" {
+			cert, err := os.ReadFile(agent.CaFile)
+			if err != nil {
+				return nil, err
+			}
+			roots = x509.NewCertPool()
+			roots.AppendCertsFromPEM(cert)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: agent.tlsConfig(roots)}
+		url = "https://" + agent.ServerAddress + "/enroll"
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("enrollment failed with status %d: %s", resp.StatusCode, e.Error)
+	}
+
+	var enrolled control.EnrollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&enrolled); err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600},
+		{CertFile, []byte(enrolled.Certificate), 0644},
+		{CAFile, []byte(enrolled.CA), 0644},
+		{AuthKeyFile, []byte(enrolled.AuthKey + "\n"), 0600},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(dir, f.name), f.data, f.perm); err != nil {
+			return nil, err
+		}
+	}
+	return &enrolled, nil
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// tlsConfig returns the TLS config for connecting to the server, trusting
+// roots. The server is verified under ServerName when set, instead of the
+// host of the dial address, and its public key must match one of the pins.
+func (agent *Agent) tlsConfig(roots *x509.CertPool) *tls.Config {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		RootCAs:    roots,
+		ServerName: agent.ServerName,
+	}
+	if len(agent.PinSHA256) > 0 {
+		c.VerifyConnection = agent.verifyPin
+	}
+	return c
+}
+
+// clientTLSConfig returns the TLS config of a new connection to the server,
+// with the current certificate and CAs.
+func (agent *Agent) clientTLSConfig() *tls.Config {
+	c := agent.tlsConfig(agent.certs.CAPool())
+	c.GetClientCertificate = agent.certs.GetClientCertificate
+	return c
+}
+
+// verifyPin checks the SHA-256 hash of the server's SubjectPublicKeyInfo
+// against the pinned ones, so that a certificate unexpectedly reissued for a
+// different key is detected even if it is signed by a trusted CA.
+func (agent *Agent) verifyPin(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no server certificate to check the pin against")
+	}
+
+	sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range agent.PinSHA256 {
+		if want, ok := decodePin(pin); ok && subtle.ConstantTimeCompare(want, sum[:]) == 1 {
+			return nil
+		}
+	}
+	return errors.New("server public key does not match the pinned SHA-256")
+}
+
+// decodePin decodes a pin, given in base64 like HPKP pins or in hex.
+func decodePin(pin string) ([]byte, bool) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+	if b, err := base64.StdEncoding.DecodeString(pin); err == nil && len(b) == sha256.Size {
+		return b, true
+	}
+	if b, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err == nil && len(b) == sha256.Size {
+		return b, true
+	}
+	return nil, false
+}
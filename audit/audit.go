@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record describes a tunneled connection, from the request of the agent to
+// the end of the session.
+type Record struct {
+	SessionID string    `json:"session_id"`
+	Agent     string    `json:"agent"`
+	CN        string    `json:"cn,omitempty"`
+	Source    string    `json:"source"`
+	DestFQDN  string    `json:"dest_fqdn,omitempty"`
+	DestIP    string    `json:"dest_ip,omitempty"`
+	DestPort  int       `json:"dest_port,omitempty"`
+	Code      uint8     `json:"code"`
+	Result    string    `json:"result"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	Start     time.Time `json:"start"`
+	// Duration is in milliseconds.
+	Duration int64 `json:"duration_ms"`
+}
+
+// Logger writes records as JSON lines, to stdout or to a file rotated when it
+// reaches its max size.
+type Logger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	file    *os.File
+	path    string
+	size    int64
+	maxSize int64
+	backups int
+}
+
+// Open opens the audit log at path, `-` is stdout. The file is rotated to
+// path.1, path.2, ... once it exceeds maxSize bytes, keeping backups files;
+// a maxSize of 0 never rotates.
+func Open(path string, maxSize int64, backups int) (*Logger, error) {
+	if path == "-" {
+		return &Logger{w: os.Stdout}, nil
+	}
+
+	l := &Logger{path: path, maxSize: maxSize, backups: backups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write appends rec to the log.
+func (l *Logger) Write(rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil && l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the log file.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// open opens the log file for appending. The caller must hold l.mu.
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.w, l.size = f, f, info.Size()
+	return nil
+}
+
+// rotate shifts the backups, moves the log file to path.1 and opens a new
+// one. The caller must hold l.mu.
+func (l *Logger) rotate() error {
+	l.file.Close()
+
+	if l.backups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.backups))
+		for i := l.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
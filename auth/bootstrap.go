@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// BootstrapToken is a single-use token allowing an agent to enroll. Only the
+// hash of the token is stored. An agent which already exists can only enroll
+// with a token allowing to replace it.
+type BootstrapToken struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Expires time.Time `json:"expires"`
+	Replace bool      `json:"replace,omitempty"`
+}
+
+// bootstrapMu serializes the updates of bootstrap token files.
+var bootstrapMu sync.Mutex
+
+// CreateBootstrapToken adds a token for the named agent to file and returns
+// it in plaintext. replace allows the token to re-enroll an existing agent.
+func CreateBootstrapToken(file, name string, ttl time.Duration, replace bool) (string, error) {
+	bootstrapMu.Lock()
+	defer bootstrapMu.Unlock()
+
+	tokens, err := readBootstrapTokens(file)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	hash, err := HashKey(token, SchemeSHA256)
+	if err != nil {
+		return "", err
+	}
+
+	tokens = append(tokens, BootstrapToken{Name: name, Hash: hash, Expires: time.Now().Add(ttl), Replace: replace})
+	return token, writeBootstrapTokens(file, tokens)
+}
+
+// FindBootstrapToken returns the unexpired token in file matching token,
+// without redeeming it.
+func FindBootstrapToken(file, token string) (BootstrapToken, error) {
+	bootstrapMu.Lock()
+	defer bootstrapMu.Unlock()
+
+	tokens, err := readBootstrapTokens(file)
+	if err != nil {
+		return BootstrapToken{}, err
+	}
+
+	now := time.Now()
+	for _, t := range tokens {
+		if !now.After(t.Expires) && VerifyKey(t.Hash, token) {
+			return t, nil
+		}
+	}
+	return BootstrapToken{}, errors.New("invalid or expired bootstrap token")
+}
+
+// RedeemBootstrapToken removes token from file and returns the name of the
+// agent it was created for. Expired tokens are dropped along the way.
+func RedeemBootstrapToken(file, token string) (string, error) {
+	bootstrapMu.Lock()
+	defer bootstrapMu.Unlock()
+
+	tokens, err := readBootstrapTokens(file)
+	if err != nil {
+		return "", err
+	}
+
+	var name string
+	kept := []BootstrapToken{}
+	now := time.Now()
+	for _, t := range tokens {
+		switch {
+		case now.After(t.Expires):
+		case name == "" && VerifyKey(t.Hash, token):
+			name = t.Name
+		default:
+			kept = append(kept, t)
+		}
+	}
+
+	if err := writeBootstrapTokens(file, kept); err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", errors.New("invalid or expired bootstrap token")
+	}
+	return name, nil
+}
+
+// readBootstrapTokens reads the tokens in file, a missing file has none.
+func readBootstrapTokens(file string) ([]BootstrapToken, error) {
+	var tokens []BootstrapToken
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tokens, json.Unmarshal(data, &tokens)
+}
+
+// writeBootstrapTokens replaces the tokens in file.
+func writeBootstrapTokens(file string, tokens []BootstrapToken) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedeemBootstrapToken(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+
+	token, err := CreateBootstrapToken(file, "laptop-01", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := CreateBootstrapToken(file, "laptop-02", time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := FindBootstrapToken(file, token)
+	if err != nil || found.Name != "laptop-01" || found.Replace {
+		t.Fatalf("FindBootstrapToken = %+v, %v, want laptop-01", found, err)
+	}
+	if _, err := FindBootstrapToken(file, token+"x"); err == nil {
+		t.Fatal("FindBootstrapToken succeeded with a wrong token")
+	}
+
+	name, err := RedeemBootstrapToken(file, token)
+	if err != nil || name != "laptop-01" {
+		t.Fatalf("RedeemBootstrapToken = %q, %v, want laptop-01", name, err)
+	}
+	if _, err := RedeemBootstrapToken(file, token); err == nil {
+		t.Fatal("token redeemed twice")
+	}
+	if _, err := FindBootstrapToken(file, token); err == nil {
+		t.Fatal("redeemed token still found")
+	}
+
+	// the other token is kept
+	if found, err := FindBootstrapToken(file, other); err != nil || found.Name != "laptop-02" || !found.Replace {
+		t.Fatalf("FindBootstrapToken = %+v, %v, want laptop-02 allowed to replace", found, err)
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("token file mode = %o, want 600", perm)
+	}
+}
+
+func TestRedeemExpiredBootstrapToken(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+
+	expired, err := CreateBootstrapToken(file, "laptop-01", -time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := CreateBootstrapToken(file, "laptop-02", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := FindBootstrapToken(file, expired); err == nil {
+		t.Fatal("expired token found")
+	}
+	if _, err := RedeemBootstrapToken(file, expired); err == nil {
+		t.Fatal("expired token redeemed")
+	}
+
+	// expired tokens are dropped from the file
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens []BootstrapToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Name != "laptop-02" {
+		t.Fatalf("tokens left = %+v, want the one of laptop-02", tokens)
+	}
+	if name, err := RedeemBootstrapToken(file, valid); err != nil || name != "laptop-02" {
+		t.Fatalf("RedeemBootstrapToken = %q, %v, want laptop-02", name, err)
+	}
+}
+
+func TestRedeemBootstrapTokenConcurrently(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+
+	token, err := CreateBootstrapToken(file, "laptop-01", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := RedeemBootstrapToken(file, token); err == nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if redeemed != 1 {
+		t.Fatalf("token redeemed %d times, want once", redeemed)
+	}
+}
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// KeySize is the number of random bytes in a generated auth key.
+const KeySize = 32
+
+// Hash schemes supported in the `auth_key` field of allowed agents.
+const (
+	SchemeArgon2id = "argon2id"
+	SchemeBcrypt   = "bcrypt"
+	SchemeSHA256   = "sha256"
+)
+
+// argon2id parameters, following the OWASP recommendation.
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// verifiedCacheSize is the maximum number of cached successful verifications.
+const verifiedCacheSize = 1024
+
+// verified caches successful verifications, so that a key verified once is
+// not run through a slow hash again while it stays cached. Entries are keyed
+// by an HMAC of the (stored hash, key) pair with a per-process secret, so
+// the cache holds neither the keys nor digests that could be brute forced.
+var verified = verifiedCache{secret: randomSecret(), entries: map[[sha256.Size]byte]struct{}{}}
+
+// verifiedCache is a set of digests holding at most verifiedCacheSize entries.
+type verifiedCache struct {
+	mu      sync.Mutex
+	secret  []byte
+	entries map[[sha256.Size]byte]struct{}
+}
+
+// digest returns the cache key of the (stored, key) pair.
+func (c *verifiedCache) digest(stored, key string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(stored))
+	mac.Write([]byte{0})
+	mac.Write([]byte(key))
+
+	var sum [sha256.Size]byte
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+// randomSecret returns a random secret for the verified cache.
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// contains reports whether digest is cached.
+func (c *verifiedCache) contains(digest [sha256.Size]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[digest]
+	return ok
+}
+
+// add caches digest, evicting an arbitrary entry when the cache is full.
+func (c *verifiedCache) add(digest [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= verifiedCacheSize {
+		for d := range c.entries {
+			delete(c.entries, d)
+			break
+		}
+	}
+	c.entries[digest] = struct{}{}
+}
+
+// GenerateKey returns a new random auth key.
+func GenerateKey() (string, error) {
+	b := make([]byte, KeySize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashKey hashes key with the given scheme, the result can be stored as
+// `auth_key` in the allowed agents config.
+func HashKey(key, scheme string) (string, error) {
+	switch scheme {
+	case SchemeArgon2id:
+		salt := make([]byte, argonSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		hash := argon2.IDKey([]byte(key), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argonMemory, argonTime, argonThreads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(hash),
+		), nil
+	case SchemeBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case SchemeSHA256:
+		sum := sha256.Sum256([]byte(key))
+		return "sha256:" + hex.EncodeToString(sum[:]), nil
+	default:
+		return "", fmt.Errorf("unsupported hash scheme: %s", scheme)
+	}
+}
+
+// IsHashed reports whether stored is a hashed key rather than a plaintext one.
+func IsHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$argon2id$") ||
+		strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$") ||
+		strings.HasPrefix(stored, "sha256:")
+}
+
+// IsVerified reports whether key was recently verified against the stored
+// key, it never computes a slow hash.
+func IsVerified(stored, key string) bool {
+	if stored == "" || key == "" {
+		return false
+	}
+	return verified.contains(verified.digest(stored, key))
+}
+
+// VerifyKey reports whether key matches the stored (hashed or plaintext) key.
+// All comparisons are done in constant time.
+func VerifyKey(stored, key string) bool {
+	if stored == "" || key == "" {
+		return false
+	}
+
+	digest := verified.digest(stored, key)
+	if verified.contains(digest) {
+		return true
+	}
+
+	var ok bool
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		ok = verifyArgon2id(stored, key)
+	case strings.HasPrefix(stored, "$2"):
+		ok = bcrypt.CompareHashAndPassword([]byte(stored), []byte(key)) == nil
+	case strings.HasPrefix(stored, "sha256:"):
+		want, err := hex.DecodeString(strings.TrimPrefix(stored, "sha256:"))
+		sum := sha256.Sum256([]byte(key))
+		ok = err == nil && subtle.ConstantTimeCompare(want, sum[:]) == 1
+	default:
+		// plaintext key, compare digests so the length is not leaked either
+		want := sha256.Sum256([]byte(stored))
+		sum := sha256.Sum256([]byte(key))
+		ok = subtle.ConstantTimeCompare(want[:], sum[:]) == 1
+	}
+
+	if ok {
+		verified.add(digest)
+	}
+	return ok
+}
+
+// verifyArgon2id verifies key against a PHC formatted argon2id hash.
+func verifyArgon2id(stored, key string) bool {
+	// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	hash := argon2.IDKey([]byte(key), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(want, hash) == 1
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashAndVerifyKey(t *testing.T) {
+	for _, scheme := range []string{SchemeArgon2id, SchemeBcrypt, SchemeSHA256} {
+		key, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := HashKey(key, scheme)
+		if err != nil {
+			t.Fatalf("HashKey(%s): %v", scheme, err)
+		}
+		if !IsHashed(stored) {
+			t.Errorf("%s: IsHashed(%q) = false", scheme, stored)
+		}
+		if !VerifyKey(stored, key) {
+			t.Errorf("%s: VerifyKey with the right key failed", scheme)
+		}
+		if VerifyKey(stored, key+"x") {
+			t.Errorf("%s: VerifyKey with a wrong key succeeded", scheme)
+		}
+		if VerifyKey(stored, "") {
+			t.Errorf("%s: VerifyKey with an empty key succeeded", scheme)
+		}
+	}
+
+	if _, err := HashKey("key", "md5"); err == nil {
+		t.Error("HashKey succeeded with an unsupported scheme")
+	}
+}
+
+func TestVerifyPlaintextKey(t *testing.T) {
+	tests := []struct {
+		stored string
+		key    string
+		want   bool
+	}{
+		{"NiIsInR5cCI6IkpXVCJ9", "NiIsInR5cCI6IkpXVCJ9", true},
+		{"NiIsInR5cCI6IkpXVCJ9", "NiIsInR5cCI6IkpXVCJ8", false},
+		{"NiIsInR5cCI6IkpXVCJ9", "NiIsInR5cCI6IkpXVCJ", false},
+		{"NiIsInR5cCI6IkpXVCJ9", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		if IsHashed(tt.stored) {
+			t.Errorf("IsHashed(%q) = true", tt.stored)
+		}
+		if got := VerifyKey(tt.stored, tt.key); got != tt.want {
+			t.Errorf("VerifyKey(%q, %q) = %v, want %v", tt.stored, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyMalformedHash(t *testing.T) {
+	stored, err := HashKey("key", SchemeArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(stored, "$")
+
+	tests := []string{
+		"$argon2id$",
+		"$argon2id$v=19$m=19456,t=2,p=1$" + parts[4],
+		"$argon2id$v=18$" + strings.Join(parts[3:], "$"),
+		"$argon2id$v=19$m=x,t=2,p=1$" + strings.Join(parts[4:], "$"),
+		"$argon2id$v=19$m=19456,t=2,p=1$!!$" + parts[5],
+		"$argon2id$v=19$m=19456,t=2,p=1$" + parts[4] + "$!!",
+		"$2a$10$short",
+		"$2b$",
+		"sha256:zz",
+		"sha256:",
+	}
+
+	for _, stored := range tests {
+		if VerifyKey(stored, "key") {
+			t.Errorf("VerifyKey(%q) succeeded", stored)
+		}
+	}
+}
+
+func TestVerifiedCache(t *testing.T) {
+	old, err := HashKey("old-key", SchemeBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsVerified(old, "old-key") {
+		t.Fatal("IsVerified before any verification")
+	}
+	if !VerifyKey(old, "old-key") {
+		t.Fatal("VerifyKey failed")
+	}
+	if !IsVerified(old, "old-key") {
+		t.Fatal("successful verification not cached")
+	}
+	if VerifyKey(old, "other-key") || IsVerified(old, "other-key") {
+		t.Fatal("cache hit for a wrong key")
+	}
+
+	// the key of the agent changes, the cached verification of the old one
+	// must not let the old key in
+	rotated, err := HashKey("new-key", SchemeBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsVerified(rotated, "old-key") || VerifyKey(rotated, "old-key") {
+		t.Fatal("old key accepted after the key changed")
+	}
+	if !VerifyKey(rotated, "new-key") {
+		t.Fatal("VerifyKey failed for the new key")
+	}
+
+	// failed verifications are not cached
+	if IsVerified(rotated, "old-key") {
+		t.Fatal("failed verification cached")
+	}
+}
+
+func TestVerifiedCacheBounded(t *testing.T) {
+	c := verifiedCache{secret: randomSecret(), entries: map[[32]byte]struct{}{}}
+	for i := 0; i < 2*verifiedCacheSize; i++ {
+		c.add(c.digest("stored", strings.Repeat("k", i+1)))
+	}
+	if len(c.entries) != verifiedCacheSize {
+		t.Fatalf("cache holds %d entries, want %d", len(c.entries), verifiedCacheSize)
+	}
+
+	// digests depend on the secret of the cache
+	other := verifiedCache{secret: randomSecret()}
+	if c.digest("stored", "k") == other.digest("stored", "k") {
+		t.Fatal("digests do not depend on the secret")
+	}
+}
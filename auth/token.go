@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the claims of a JWT agent credential. The credential stands in
+// for an entry of the allowed agents config; `exp` is mandatory.
+type Claims struct {
+	Name                string   `json:"name"`
+	Groups              []string `json:"groups,omitempty"`
+	AllowedDestinations []string `json:"allowed_destinations,omitempty"`
+	// ApprovedCNs defaults to the agent name when empty.
+	ApprovedCNs []string `json:"approved_cns,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// IsToken reports whether credential looks like a JWT rather than an opaque
+// auth key: three base64url encoded parts, the first one being a JSON header
+// naming the signing algorithm.
+func IsToken(credential string) bool {
+	parts := strings.Split(credential, ".")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return false
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	return json.Unmarshal(data, &header) == nil && header.Alg != ""
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/easzlab/ezvpn/agent"
+)
+
+// enroll enrolls this machine with a bootstrap token from the server admin
+// (`ezvpn-server enroll-token`), and writes the agent cert, key, CA bundle
+// and auth key to the output directory.
+func enroll(args []string) error {
+	a := agent.Agent{}
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	fs.StringVar(&a.ServerAddress, "server", "127.0.0.1:8445", "Specify the enrollment address of the server")
+	fs.StringVar(&a.ServerName, "server-name", "", "Specify the name to verify the server cert for, defaults to the host of -server")
+	fs.StringVar(&a.CaFile, "ca", "./ca.pem", "Specify the trusted ca file, empty to use the system roots")
+	fs.BoolVar(&a.EnableTLS, "tls", true, "To enable tls between agent and server or not")
+	pins := fs.String("pin-sha256", "", "Specify the comma separated SHA-256 pins of the server public key")
+	token := fs.String("token", "", "Specify the bootstrap token")
+	dir := fs.String("dir", ".", "Specify the directory to write the enrolled files to")
+	fs.Parse(args)
+	a.PinSHA256 = split(*pins)
+
+	if *token == "" {
+		return errors.New("-token is required")
+	}
+
+	enrolled, err := a.Enroll(*token, *dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("agent %s enrolled, files written to %s\n", enrolled.Name, *dir)
+	fmt.Printf("run: ezvpn-agent -server <control address> -auth $(cat %s) -ca %s -cert %s -key %s\n",
+		filepath.Join(*dir, agent.AuthKeyFile), filepath.Join(*dir, agent.CAFile),
+		filepath.Join(*dir, agent.CertFile), filepath.Join(*dir, agent.KeyFile))
+	return nil
+}
@@ -4,20 +4,40 @@ import (
 	"context"
 	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/easzlab/ezvpn/agent"
-	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/logging"
 )
 
+// commands are the subcommands of ezvpn-agent, running the agent is the
+// default when none is given.
+var commands = map[string]func(args []string) error{
+	"enroll": enroll,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	a := agent.Agent{}
 	flag.StringVar(&a.AuthKey, "auth", "xxx", "Specify the authentication key")
+	flag.StringVar(&a.Name, "name", "", "Specify the agent name on the server, needed when several allowed agents match the agent cert")
 	flag.BoolVar(&a.EnableTLS, "tls", true, "To enable tls between agent and server or not")
 	flag.BoolVar(&a.EnablePprof, "pprof", false, "To enable pprof or not")
 	flag.StringVar(&a.CaFile, "ca", "./ca.pem", "Specify the trusted ca file")
@@ -25,39 +45,77 @@ func main() {
 	flag.StringVar(&a.KeyFile, "key", "./agent-key.pem", "Specify the agent key file")
 	flag.StringVar(&a.LocalAddress, "local", ":16116", "Specify the local address")
 	flag.StringVar(&a.ServerAddress, "server", "127.0.0.1:8443", "Specify the server address")
+	flag.StringVar(&a.ServerName, "server-name", "", "Specify the name to verify the server cert for, defaults to the host of -server")
+	flag.StringVar(&a.Transport, "transport", "websocket", "Specify the transport to the server, websocket, mux or quic")
+	flag.BoolVar(&a.Compression, "compression", false, "To ask the server for compressed sessions or not, enable it on metered links")
+	flag.DurationVar(&a.DrainTimeout, "drain-timeout", 10*time.Second, "Specify how long live sessions are waited for on shutdown")
+	pins := flag.String("pin-sha256", "", "Specify the comma separated SHA-256 pins of the server public key")
+	logFormat := flag.String("log-format", "text", "Specify the log format, text or json")
+	logLevel := flag.String("log-level", "info", "Specify the log level: debug, info, warn or error")
+	logLevels := flag.String("log-levels", "", "Specify the comma separated log levels per component, e.g. agent=debug,pki=warn")
 	flag.Parse()
+	a.PinSHA256 = split(*pins)
+
+	if err := logging.Setup(os.Stderr, *logFormat, *logLevel, *logLevels); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	if err := a.CheckTransport(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
 
+	// log levels can be switched at runtime next to the pprof handlers, which
+	// are only served on loopback as neither is authenticated
 	if a.EnablePprof {
-		go http.ListenAndServe("0.0.0.0:6061", nil)
+		http.Handle("/debug/loglevel", logging.Handler())
+		go http.ListenAndServe("127.0.0.1:6061", nil)
 	}
 
-	if err := run(a); err != nil {
-		log.Printf("error: %s", err)
+	if err := run(&a); err != nil {
+		slog.Error("agent stopped", "error", err)
 		os.Exit(1)
 	}
 }
 
-func run(a agent.Agent) error {
+func run(a *agent.Agent) error {
 	ctx := withSignalCancel(context.Background())
 	err := a.Start(ctx)
 
 	if errors.Is(err, context.Canceled) {
-		log.Printf("the agent proc is canceled, waiting for it to stop...")
-		time.Sleep(config.AgentCancelWait)
+		slog.Info("ezvpn agent stopped")
 		return nil
 	}
 
 	return err
 }
 
+// split splits a comma separated list, ignoring empty items.
+func split(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// withSignalCancel returns a context canceled on SIGTERM or interrupt, which
+// shuts the agent down gracefully. A second signal exits at once.
 func withSignalCancel(ctx context.Context) context.Context {
 	newCtx, cancel := context.WithCancel(ctx)
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-sigCh
+		sig := <-sigCh
+		slog.Info("shutting down", "signal", sig.String())
 		cancel()
+
+		<-sigCh
+		slog.Warn("exiting without draining the sessions")
+		os.Exit(1)
 	}()
 	return newCtx
 }
@@ -0,0 +1,457 @@
+// Command bench measures the throughput, CPU and allocations of the tunnel
+// data path over loopback, for the legacy copy loops and the relay package
+// over the websocket, the mux and the QUIC transports.
+//
+// A tunnel is set up the way agents and the server run it:
+//
+//	client --tcp--> send/receive --ws--> receive/send --tcp--> destination
+//
+// Bulk transfers are timed from client to destination, interactive ones by
+// the round trip of small writes echoed by the destination.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/pki"
+	"github.com/easzlab/ezvpn/relay"
+	"github.com/easzlab/ezvpn/transport"
+	"github.com/gorilla/websocket"
+)
+
+// tunnel sets up a tunnel between the agent and the server ends of a session,
+// it returns a function tearing the tunnel down.
+type tunnel func(agentConn, serverConn net.Conn) (func(), error)
+
+var tunnels = map[string]tunnel{
+	"legacy": legacyTunnel,
+	"relay":  relayTunnel,
+	"mux":    muxTunnel,
+	"quic":   quicTunnel,
+}
+
+// legacyTunnel copies the data of a session the way it was before the relay
+// package, over a websocket with the default buffers.
+func legacyTunnel(agentConn, serverConn net.Conn) (func(), error) {
+	upgrader := websocket.Upgrader{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		go legacyReceive(ws, serverConn)
+		go legacySend(ws, serverConn)
+	})}
+	go srv.Serve(l)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+l.Addr().String()+"/session", nil)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	go legacySend(ws, agentConn)
+	go legacyReceive(ws, agentConn)
+
+	return func() {
+		ws.Close()
+		srv.Close()
+	}, nil
+}
+
+// relayTunnel copies the data of a session with the relay package, over the
+// websocket transport.
+func relayTunnel(agentConn, serverConn net.Conn) (func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := transport.WebSocketRequest(w, r, "", r.URL.Path)
+		if r.URL.Path == "/register" {
+			conn, err := req.AcceptConn()
+			if err != nil {
+				return
+			}
+			go func() {
+				for _, err := conn.ReadMessage(); err == nil; _, err = conn.ReadMessage() {
+				}
+			}()
+			return
+		}
+
+		stream, err := req.AcceptStream("bench", false)
+		if err != nil {
+			return
+		}
+		go relay.Receive(stream, serverConn, nil)
+		go relay.Send(stream, serverConn, nil)
+	})}
+	go srv.Serve(l)
+
+	t := &transport.WebSocket{Address: l.Addr().String()}
+	ctrl, err := t.Dial(context.Background(), http.Header{})
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	stream, err := ctrl.Open(context.Background(), http.Header{})
+	if err != nil {
+		ctrl.Close()
+		srv.Close()
+		return nil, err
+	}
+	go relay.Send(stream, agentConn, nil)
+	go relay.Receive(stream, agentConn, nil)
+
+	return func() {
+		stream.Close()
+		ctrl.Close()
+		srv.Close()
+	}, nil
+}
+
+// muxTunnel copies the data of a session with the relay package, over the
+// mux transport.
+func muxTunnel(agentConn, serverConn net.Conn) (func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go transport.ServeMux(l, func(req *transport.Request) {
+		if req.Route == "/register" {
+			conn, err := req.AcceptConn()
+			if err != nil {
+				return
+			}
+			for _, err := conn.ReadMessage(); err == nil; _, err = conn.ReadMessage() {
+			}
+			return
+		}
+
+		stream, err := req.AcceptStream("bench", false)
+		if err != nil {
+			return
+		}
+		go relay.Receive(stream, serverConn, nil)
+		go relay.Send(stream, serverConn, nil)
+	})
+
+	t := &transport.Mux{Address: l.Addr().String()}
+	ctrl, err := t.Dial(context.Background(), http.Header{})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	stream, err := ctrl.Open(context.Background(), http.Header{})
+	if err != nil {
+		ctrl.Close()
+		l.Close()
+		return nil, err
+	}
+	go relay.Send(stream, agentConn, nil)
+	go relay.Receive(stream, agentConn, nil)
+
+	return func() {
+		stream.Close()
+		ctrl.Close()
+		l.Close()
+	}, nil
+}
+
+// quicTunnel copies the data of a session with the relay package, over the
+// QUIC transport, with certificates of a throwaway CA.
+func quicTunnel(agentConn, serverConn net.Conn) (func(), error) {
+	serverTLS, clientTLS, err := benchTLS()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv, err := transport.ListenQUIC(pc, serverTLS, 0)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go srv.Serve(func(req *transport.Request) {
+		if req.Route == "/register" {
+			conn, err := req.AcceptConn()
+			if err != nil {
+				return
+			}
+			for _, err := conn.ReadMessage(); err == nil; _, err = conn.ReadMessage() {
+			}
+			return
+		}
+
+		stream, err := req.AcceptStream("bench", false)
+		if err != nil {
+			return
+		}
+		go relay.Receive(stream, serverConn, nil)
+		go relay.Send(stream, serverConn, nil)
+	})
+
+	t := &transport.QUIC{Address: pc.LocalAddr().String(), TLSConfig: clientTLS}
+	ctrl, err := t.Dial(context.Background(), http.Header{})
+	if err != nil {
+		srv.Close("")
+		return nil, err
+	}
+	stream, err := ctrl.Open(context.Background(), http.Header{})
+	if err != nil {
+		ctrl.Close()
+		srv.Close("")
+		return nil, err
+	}
+	go relay.Send(stream, agentConn, nil)
+	go relay.Receive(stream, agentConn, nil)
+
+	return func() {
+		stream.Close()
+		ctrl.Close()
+		srv.Close("")
+	}, nil
+}
+
+// benchTLS returns the TLS configs of the server and the agent, with
+// certificates issued by a throwaway CA.
+func benchTLS() (*tls.Config, func() *tls.Config, error) {
+	dir, err := os.MkdirTemp("", "ezvpn-bench")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := pki.InitCA(dir, time.Hour); err != nil {
+		return nil, nil, err
+	}
+	if err := pki.IssueServer(dir, []string{"127.0.0.1"}, time.Hour); err != nil {
+		return nil, nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, pki.ServerFile), filepath.Join(dir, pki.ServerKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := pki.ReadCertificate(filepath.Join(dir, pki.CAFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, func() *tls.Config {
+		return &tls.Config{RootCAs: roots}
+	}, nil
+}
+
+// legacySend is the copy loop used before the relay package, a message per
+// read from a buffer of config.BufferSize.
+func legacySend(ws *websocket.Conn, conn net.Conn) error {
+	buf := make([]byte, config.BufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// legacyReceive is the copy loop used before the relay package.
+func legacyReceive(ws *websocket.Conn, conn net.Conn) error {
+	buf := make([]byte, config.BufferSize)
+	for {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyBuffer(conn, r, buf); err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	size := flag.String("size", "1GB", "Specify the size of each bulk transfer")
+	chunk := flag.Int("chunk", 32*1024, "Specify the size of the client writes of bulk transfers")
+	rounds := flag.Int("rounds", 5000, "Specify the number of interactive round trips")
+	names := flag.String("tunnels", "legacy,relay,mux,quic", "Specify the comma separated tunnels to compare")
+	flag.Parse()
+
+	n, err := config.ParseSize(*size)
+	if err != nil || n <= 0 {
+		fmt.Fprintln(os.Stderr, "error: invalid size:", *size)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TUNNEL\tBULK\tCPU/GB\tALLOC/GB\tRTT")
+	for _, name := range strings.Split(*names, ",") {
+		t, ok := tunnels[name]
+		if !ok {
+			fmt.Fprintln(os.Stderr, "error: unknown tunnel:", name)
+			os.Exit(1)
+		}
+
+		b, err := bulk(t, n, *chunk)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		rtt, err := interactive(t, *rounds)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+
+		gb := float64(n) / (1 << 30)
+		fmt.Fprintf(w, "%s\t%.0f MB/s\t%.2fs\t%.1f MB\t%v\n", name,
+			float64(n)/b.elapsed.Seconds()/(1<<20),
+			b.cpu.Seconds()/gb,
+			float64(b.alloc)/gb/(1<<20),
+			rtt.Round(time.Microsecond))
+	}
+	w.Flush()
+}
+
+// result is the cost of a bulk transfer.
+type result struct {
+	elapsed time.Duration
+	cpu     time.Duration
+	alloc   uint64
+}
+
+// bulk transfers size bytes from the client to the destination.
+func bulk(t tunnel, size int64, chunk int) (result, error) {
+	client, dest, closeTunnel, err := newTunnel(t)
+	if err != nil {
+		return result{}, err
+	}
+	defer closeTunnel()
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	cpu := cpuTime()
+	start := time.Now()
+
+	errCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, chunk)
+		for left := size; left > 0; left -= int64(len(buf)) {
+			if left < int64(len(buf)) {
+				buf = buf[:left]
+			}
+			if _, err := client.Write(buf); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	if _, err := io.CopyN(io.Discard, dest, size); err != nil {
+		return result{}, err
+	}
+	if err := <-errCh; err != nil {
+		return result{}, err
+	}
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	return result{
+		elapsed: time.Since(start),
+		cpu:     cpuTime() - cpu,
+		alloc:   after.TotalAlloc - before.TotalAlloc,
+	}, nil
+}
+
+// interactive returns the mean round trip of small writes, echoed by the
+// destination.
+func interactive(t tunnel, rounds int) (time.Duration, error) {
+	client, dest, closeTunnel, err := newTunnel(t)
+	if err != nil {
+		return 0, err
+	}
+	defer closeTunnel()
+
+	go io.Copy(dest, dest)
+
+	msg := make([]byte, 64)
+	start := time.Now()
+	for i := 0; i < rounds; i++ {
+		if _, err := client.Write(msg); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(client, msg); err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start) / time.Duration(rounds), nil
+}
+
+// newTunnel returns the client and destination ends of a tunnel set up by t,
+// and a function tearing it down.
+func newTunnel(t tunnel) (net.Conn, net.Conn, func(), error) {
+	client, agentConn, err := tcpPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serverConn, dest, err := tcpPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	closeTunnel, err := t(agentConn, serverConn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return client, dest, func() {
+		closeTunnel()
+		for _, c := range []io.Closer{client, agentConn, serverConn, dest} {
+			c.Close()
+		}
+	}, nil
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair() (net.Conn, net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := l.Accept()
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, s, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/pki"
+)
+
+// ca manages the built-in certificate authority:
+//
+//	ezvpn-server ca init
+//	ezvpn-server ca issue-server -hosts vpn.easzlab.io,127.0.0.1
+//	ezvpn-server ca issue-agent -name laptop-01
+//	ezvpn-server ca revoke -cert laptop-01.pem
+func ca(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ezvpn-server ca <init|issue-server|issue-agent|revoke> [flags]")
+	}
+
+	fs := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	dir := fs.String("dir", ".", "Specify the directory of the CA and issued certs")
+	days := fs.Int("days", 0, "Specify the validity in days, defaults to 365 for agent certs and 3650 otherwise")
+
+	switch args[0] {
+	case "init":
+		fs.Parse(args[1:])
+		if err := pki.InitCA(*dir, validity(*days, config.CertValidity)); err != nil {
+			return err
+		}
+		fmt.Printf("CA created: %s\n", filepath.Join(*dir, pki.CAFile))
+
+	case "issue-server":
+		hosts := fs.String("hosts", "localhost,127.0.0.1", "Specify the comma separated DNS names and IPs of the server")
+		fs.Parse(args[1:])
+		if err := pki.IssueServer(*dir, split(*hosts), validity(*days, config.CertValidity)); err != nil {
+			return err
+		}
+		fmt.Printf("server cert issued: %s\n", filepath.Join(*dir, pki.ServerFile))
+
+	case "issue-agent":
+		name := fs.String("name", "", "Specify the agent name, used as the cert CN and SAN")
+		configFile := fs.String("config", "./config/allowed-agents.yml", "Specify the config file to approve the cert CN in")
+		fs.Parse(args[1:])
+		if *name == "" {
+			return errors.New("-name is required")
+		}
+
+		if err := pki.IssueAgent(*dir, *name, validity(*days, config.AgentCertValidity)); err != nil {
+			return err
+		}
+		fmt.Printf("agent cert issued: %s\n", filepath.Join(*dir, *name+".pem"))
+
+		key, err := config.ApproveCN(*configFile, *name, *name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("CN %s approved for agent %s in %s\n", *name, *name, *configFile)
+		if key != "" {
+			fmt.Printf("new agent added, auth key (give it to the agent): %s\n", key)
+		}
+
+	case "revoke":
+		certFile := fs.String("cert", "", "Specify the cert file to revoke")
+		fs.Parse(args[1:])
+		if *certFile == "" {
+			return errors.New("-cert is required")
+		}
+
+		cert, err := pki.ReadCertificate(*certFile)
+		if err != nil {
+			return err
+		}
+		if err := pki.Revoke(*dir, cert, validity(*days, config.CertValidity)); err != nil {
+			return err
+		}
+		fmt.Printf("cert %s (serial %s) revoked, CRL written: %s\n", cert.Subject.CommonName,
+			cert.SerialNumber, filepath.Join(*dir, pki.CRLFile))
+
+	default:
+		return fmt.Errorf("unknown ca command: %s", args[0])
+	}
+	return nil
+}
+
+// validity converts a number of days to a duration, 0 days is def.
+func validity(days int, def time.Duration) time.Duration {
+	if days == 0 {
+		return def
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/easzlab/ezvpn/auth"
+	"github.com/easzlab/ezvpn/pki"
+)
+
+// enrollToken creates a single-use bootstrap token, with which a new agent
+// can enroll by running `ezvpn-agent enroll`.
+func enrollToken(args []string) error {
+	fs := flag.NewFlagSet("enroll-token", flag.ExitOnError)
+	name := fs.String("name", "", "Specify the name of the agent to enroll")
+	file := fs.String("enroll-tokens", "./config/enroll-tokens.json", "Specify the bootstrap tokens file")
+	ttl := fs.Duration("ttl", 24*time.Hour, "Specify the lifetime of the token")
+	replace := fs.Bool("replace", false, "To allow the token to re-enroll an existing agent, replacing its auth key")
+	fs.Parse(args)
+
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+	if err := pki.ValidateAgentName(*name); err != nil {
+		return err
+	}
+
+	token, err := auth.CreateBootstrapToken(*file, *name, *ttl, *replace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("bootstrap token for agent %s (valid for %s): %s\n", *name, *ttl, token)
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/easzlab/ezvpn/auth"
+)
+
+// genkey generates a new random auth key and prints it along with its hash,
+// which is what goes into the `auth_key` field of allowed-agents.yml.
+func genkey(args []string) error {
+	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+	scheme := fs.String("hash", auth.SchemeArgon2id, "Specify the hash scheme: argon2id, bcrypt or sha256")
+	fs.Parse(args)
+
+	key, err := auth.GenerateKey()
+	if err != nil {
+		return err
+	}
+	hash, err := auth.HashKey(key, *scheme)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("auth key (give it to the agent): %s\n", key)
+	fmt.Printf("auth_key (put it in the config): %s\n", hash)
+	return nil
+}
@@ -1,44 +1,178 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/handoff"
+	"github.com/easzlab/ezvpn/logging"
 	"github.com/easzlab/ezvpn/server"
 	"github.com/easzlab/ezvpn/socks"
 )
 
+// commands are the subcommands of ezvpn-server, running the server is the
+// default when none is given.
+var commands = map[string]func(args []string) error{
+	"genkey":       genkey,
+	"token":        token,
+	"ca":           ca,
+	"enroll-token": enrollToken,
+	"usage":        showUsage,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	s := config.Server{}
 	flag.BoolVar(&s.EnableTLS, "tls", true, "To enable tls between agent and server or not")
 	flag.BoolVar(&s.EnablePprof, "pprof", false, "To enable pprof or not")
+	flag.BoolVar(&s.LegacyAuth, "legacy-auth", true, "To accept auth keys in the URL path from old agents or not")
 	flag.StringVar(&s.ControlAddress, "listen", ":8443", "Specify the control address")
+	flag.StringVar(&s.MuxAddress, "mux-listen", "", "Specify the address of the mux transport, disabled when empty, requires TLS")
+	flag.StringVar(&s.QUICAddress, "quic-listen", "", "Specify the UDP address of the QUIC transport, disabled when empty, requires TLS")
 	flag.StringVar(&s.ConfigFile, "config", "./config/allowed-agents.yml", "Specify the config file")
 	flag.StringVar(&s.CaFile, "ca", "./ca.pem", "Specify the trusted ca file")
 	flag.StringVar(&s.CertFile, "cert", "./server.pem", "Specify the server cert file")
 	flag.StringVar(&s.KeyFile, "key", "./server-key.pem", "Specify the server key file")
-	flag.StringVar(&s.SocksServer, "socks5", "0.0.0.0:6116", "Specify the socks server address")
+	flag.StringVar(&s.SocksServer, "socks5", "", "Specify the loopback address of a standalone socks server for debugging, disabled when empty")
+	flag.StringVar(&s.CADir, "ca-dir", "", "Specify the built-in CA directory, to enable agent enrollment")
+	flag.StringVar(&s.EnrollAddress, "enroll-listen", ":8445", "Specify the address agents enroll at, when -ca-dir is set")
+	flag.StringVar(&s.EnrollTokens, "enroll-tokens", "./config/enroll-tokens.json", "Specify the bootstrap tokens file")
+	flag.StringVar(&s.RateLimit, "rate-limit", "", "Specify the server-wide rate limit of each direction, e.g. 1Gbit")
+	flag.StringVar(&s.UsageFile, "usage-file", "./config/usage.json", "Specify the file persisting the traffic usage of agents")
+	flag.StringVar(&s.AuditLog, "audit-log", "", "Specify the file connections are recorded to as JSON lines, - for stdout")
+	flag.StringVar(&s.AuditLogMaxSize, "audit-log-max-size", "100MB", "Specify the size the audit log is rotated at")
+	flag.IntVar(&s.AuditLogBackups, "audit-log-backups", 10, "Specify the number of rotated audit logs to keep")
+	flag.DurationVar(&s.DrainTimeout, "drain-timeout", 30*time.Second, "Specify how long active sessions are waited for on shutdown")
+	flag.StringVar(&s.AdminAddress, "admin", "", "Specify the admin address serving metrics and admin views, keep it private")
+	crlFiles := flag.String("crl", "", "Specify the comma separated CRL files to check agent certs against")
+	allowlist := flag.String("auth-allowlist", "", "Specify the comma separated IPs or CIDRs never locked out after failed auths")
+	proxies := flag.String("trusted-proxies", "", "Specify the comma separated IPs or CIDRs of proxies trusted to set X-Forwarded-For")
+	logFormat := flag.String("log-format", "text", "Specify the log format, text or json")
+	logLevel := flag.String("log-level", "info", "Specify the log level: debug, info, warn or error")
+	logLevels := flag.String("log-levels", "", "Specify the comma separated log levels per component, e.g. socks=debug,http=warn")
 	flag.Parse()
 
+	if err := logging.Setup(os.Stderr, *logFormat, *logLevel, *logLevels); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	s.CRLFiles = split(*crlFiles)
+	s.AuthAllowlist = split(*allowlist)
+	s.TrustedProxies = split(*proxies)
+
 	// load configuration
 	config.SERVER = s
 	config.SERVER.HotReload()
 
+	// log levels can be switched at runtime next to the pprof handlers, which
+	// are only served on loopback as neither is authenticated
 	if s.EnablePprof {
-		go http.ListenAndServe("0.0.0.0:6060", nil)
+		http.Handle("/debug/loglevel", logging.Handler())
+		l, err := handoff.Listen("pprof", "127.0.0.1:6060")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to start the pprof server:", err)
+			os.Exit(1)
+		}
+		go http.Serve(l, nil)
+	}
+
+	if s.AdminAddress != "" {
+		if err := server.StartAdmin(s.AdminAddress); err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to start the admin server:", err)
+			os.Exit(1)
+		}
 	}
 
-	// run socks server
+	// run the standalone socks server, it enforces no allowed destinations and
+	// is therefore only served on loopback
 	socksServer := socks.Server{ListenAddr: s.SocksServer}
-	go socksServer.Run()
+	if s.SocksServer != "" {
+		if !isLoopback(s.SocksServer) {
+			fmt.Fprintln(os.Stderr, "error: the socks server must listen on a loopback address:", s.SocksServer)
+			os.Exit(1)
+		}
+		l, err := handoff.Listen("socks", s.SocksServer)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		go socksServer.Serve(l)
+	}
+
+	// shut down gracefully on SIGTERM or interrupt, or once a new process
+	// took over the listeners on SIGUSR2
+	done := make(chan struct{})
+	go func() {
+		waitStop()
+		socksServer.Close()
+		if err := server.Shutdown(s.DrainTimeout); err != nil {
+			slog.Error("failed to shut down", "error", err)
+		}
+		close(done)
+	}()
 
 	// run ezvpn server
-	if err := server.Start(); err != nil {
+	if err := server.Start(); !errors.Is(err, http.ErrServerClosed) {
 		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
 	}
+	<-done
+	slog.Info("ezvpn server stopped")
+}
+
+// isLoopback reports whether the host of address is a loopback address.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// waitStop returns once the server is to be stopped, on SIGTERM or interrupt,
+// or after a successful upgrade.
+func waitStop() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	upgradeCh := make(chan os.Signal, 1)
+	handoff.NotifyUpgrade(upgradeCh)
+
+	for {
+		select {
+		case sig := <-sigCh:
+			slog.Info("shutting down", "signal", sig.String())
+			return
+		case <-upgradeCh:
+			pid, err := server.Upgrade()
+			if err != nil {
+				slog.Error("upgrade failed, keep running", "error", err)
+				continue
+			}
+			slog.Info("new process started, draining this one", "pid", pid)
+			return
+		}
+	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/easzlab/ezvpn/auth"
+	"github.com/easzlab/ezvpn/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+)
+
+// token issues a signed JWT credential for an agent, so that access can be
+// handed out for a limited time without editing allowed-agents.yml.
+func token(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	configFile := fs.String("config", "./config/allowed-agents.yml", "Specify the config file holding the jwt keys")
+	kid := fs.String("kid", "", "Specify the id of the jwt key to sign with")
+	signingKey := fs.String("signing-key", "", "Specify the ed25519 private key file, required for EdDSA keys")
+	name := fs.String("name", "", "Specify the agent name")
+	groups := fs.String("groups", "", "Specify the comma separated groups of the agent")
+	allow := fs.String("allow", "", "Specify the comma separated destinations the agent may connect to")
+	cns := fs.String("cns", "", "Specify the comma separated approved cert CNs, defaults to the agent name")
+	ttl := fs.Duration("ttl", 24*time.Hour, "Specify the lifetime of the credential")
+	fs.Parse(args)
+
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+
+	v := viper.New()
+	v.SetConfigFile(*configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	var agents config.AllowedAgents
+	if err := v.Unmarshal(&agents); err != nil {
+		return err
+	}
+
+	var key *config.JWTKey
+	for i := range agents.JWTKeys {
+		if agents.JWTKeys[i].ID == *kid {
+			key = &agents.JWTKeys[i]
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("no jwt key with id %q in %s", *kid, *configFile)
+	}
+
+	now := time.Now()
+	claims := auth.Claims{
+		Name:                *name,
+		Groups:              split(*groups),
+		AllowedDestinations: split(*allow),
+		ApprovedCNs:         split(*cns),
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(*ttl)),
+		},
+	}
+
+	var t *jwt.Token
+	var secret interface{}
+	switch key.Algorithm {
+	case "HS256":
+		t = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		var err error
+		if secret, err = key.VerificationKey(); err != nil {
+			return err
+		}
+	case "EdDSA":
+		if *signingKey == "" {
+			return errors.New("-signing-key is required for EdDSA keys")
+		}
+		data, err := os.ReadFile(*signingKey)
+		if err != nil {
+			return err
+		}
+		if secret, err = jwt.ParseEdPrivateKeyFromPEM(data); err != nil {
+			return err
+		}
+		t = jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	default:
+		return fmt.Errorf("unsupported alg: %s", key.Algorithm)
+	}
+	t.Header["kid"] = key.ID
+
+	signed, err := t.SignedString(secret)
+	if err != nil {
+		return err
+	}
+	fmt.Println(signed)
+	return nil
+}
+
+// split splits a comma separated list, ignoring empty items.
+func split(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
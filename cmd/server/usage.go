@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/usage"
+)
+
+// showUsage prints the traffic usage of agents in the current day and month,
+// along with their quotas from the config file.
+func showUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	file := fs.String("usage-file", "./config/usage.json", "Specify the file persisting the traffic usage of agents")
+	configFile := fs.String("config", "./config/allowed-agents.yml", "Specify the config file, to show the quotas")
+	name := fs.String("name", "", "Specify the agent to show, all agents by default")
+	fs.Parse(args)
+
+	store, err := usage.Open(*file)
+	if err != nil {
+		return err
+	}
+
+	quotas := map[string]config.Agent{}
+	if agents, err := config.LoadAgents(*configFile); err == nil {
+		for _, agent := range agents.Agents {
+			quotas[agent.Name] = agent
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "AGENT\tDAY\tUP\tDOWN\tDAILY QUOTA\tMONTH\tUP\tDOWN\tMONTHLY QUOTA")
+	for _, u := range store.List() {
+		if *name != "" && u.Agent != *name {
+			continue
+		}
+		agent := quotas[u.Agent]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", u.Agent,
+			u.Day, size(u.DayBytes.Up), size(u.DayBytes.Down), quota(agent.DailyQuota),
+			u.Month, size(u.MonthBytes.Up), size(u.MonthBytes.Down), quota(agent.MonthlyQuota))
+	}
+	return w.Flush()
+}
+
+// size formats n bytes with a binary unit.
+func size(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, i := float64(n)/unit, 0
+	for value >= unit && i < 3 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f%cB", value, "KMGT"[i])
+}
+
+// quota formats an unset quota as `-`.
+func quota(q string) string {
+	if q == "" {
+		return "-"
+	}
+	return q
+}
@@ -0,0 +1,40 @@
+// Package compression decides which tunnel messages are worth compressing.
+package compression
+
+import (
+	"math"
+
+	"github.com/easzlab/ezvpn/config"
+)
+
+// Worth returns whether b is likely to shrink when compressed. Small messages
+// are not, nor are TLS records, archives and media, which look random: their
+// Shannon entropy is close to 8 bits per byte.
+func Worth(b []byte) bool {
+	if len(b) < config.CompressMinSize {
+		return false
+	}
+	if len(b) > config.CompressSampleSize {
+		b = b[:config.CompressSampleSize]
+	}
+	return entropy(b) < config.CompressMaxEntropy
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+
+	n := float64(len(b))
+	var e float64
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / n
+		e -= p * math.Log2(p)
+	}
+	return e
+}
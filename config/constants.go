@@ -2,15 +2,35 @@ package config
 
 import "time"
 
-// BufferSize is the max size of a single message transferred via a tunnel. This
-// should be sufficiently large to prevent fragmentation.
+// BufferSize is the read buffer size of interactive sessions, a read filling
+// it marks a bulk transfer. This should be sufficiently large to prevent
+// fragmentation.
 const BufferSize = 1500
 
+// MaxMessageSize is the size of the messages bulk transfers are coalesced
+// into, as well as the write buffer size of websocket connections.
+const MaxMessageSize = 32 * 1024
+
+// CoalesceWait is how long a bulk transfer waits for more data to fill a
+// message.
+const CoalesceWait = 1 * time.Millisecond
+
+// CompressMinSize is the size below which tunnel messages are not compressed.
+const CompressMinSize = 512
+
+// CompressSampleSize is the size of the start of a message its entropy is
+// estimated from.
+const CompressSampleSize = 1024
+
+// CompressMaxEntropy is the entropy, in bits per byte, from which tunnel
+// messages are taken for encrypted or already compressed and sent as is.
+const CompressMaxEntropy = 7.0
+
 // SessionIDSize is the number of random bytes encoded in a session ID.
 const SessionIDSize = 16
 
-// AgentCancelWait is the timeout for agents to cancel
-const AgentCancelWait = 3 * time.Second
+// SessionIDHeader is the response header carrying the session ID to the agent.
+const SessionIDHeader = "Session-Id"
 
 // AgentRetryInterval is the timeout for a failed agent.Start()
 const AgentRetryInterval = 15 * time.Second
@@ -18,6 +38,52 @@ const AgentRetryInterval = 15 * time.Second
 // WsHandshakeTimeout is the timeout for agents connecting to tunnel-servers
 const WsHandshakeTimeout = 10 * time.Second
 
+// HandshakeMaxSize bounds the handshake opening a stream of the stream based
+// transports, as well as their control messages.
+const HandshakeMaxSize = 16 * 1024
+
+// MuxWindowSize is the receive window of a stream of the mux transport.
+const MuxWindowSize = 1024 * 1024
+
+// MuxMaxStreams is the number of streams an agent may have open over the mux
+// transport, which bounds its concurrent sessions.
+const MuxMaxStreams = 1024
+
+// MuxStreamRate is the number of streams an agent may open per second over a
+// mux connection, up to MuxStreamBurst at once. Every stream carries the
+// credential of the agent, which is verified when it is opened.
+const MuxStreamRate = 100
+
+// MuxStreamBurst is the number of streams opened at once over a mux
+// connection before MuxStreamRate applies.
+const MuxStreamBurst = 200
+
+// QUICProtocol is the ALPN protocol of the QUIC transport.
+const QUICProtocol = "ezvpn"
+
+// QUICMaxStreams is the number of streams an agent may have open over QUIC,
+// which bounds its concurrent sessions.
+const QUICMaxStreams = 1024
+
+// QUICStreamRate is the number of streams an agent may open per second over a
+// QUIC connection, up to QUICStreamBurst at once, as over mux.
+const QUICStreamRate = 100
+
+// QUICStreamBurst is the number of streams opened at once over a QUIC
+// connection before QUICStreamRate applies.
+const QUICStreamBurst = 200
+
+// QUICMaxIdleTimeout is how long a QUIC connection survives without a packet
+// from the peer, e.g. while the agent switches networks.
+const QUICMaxIdleTimeout = 30 * time.Second
+
+// QUICConnIDLength is the length of the connection IDs of the QUIC server.
+const QUICConnIDLength = 8
+
+// NetworkCheckInterval is how often agents connected over QUIC check whether
+// the local address changed, to migrate the connection to the new network.
+const NetworkCheckInterval = 2 * time.Second
+
 // WsCloseTimeout is the timeout of a WebSocket close message.
 const WsCloseTimeout = 3 * time.Second
 
@@ -35,3 +101,47 @@ const UdpSessionTimeout = 300 * time.Second
 
 // GoroutinePoolSize is the size for initializing an ants.Pool.
 const GoroutinePoolSize = 10000
+
+// TicketTTL is the lifetime of a session ticket issued to an agent.
+const TicketTTL = 5 * time.Minute
+
+// TicketRotateInterval is how often a registered agent gets a fresh ticket.
+const TicketRotateInterval = 1 * time.Minute
+
+// AgentCertValidity is the validity of the certificates of enrolled agents,
+// and the default validity of the agent certificates issued by the CA.
+const AgentCertValidity = 365 * 24 * time.Hour
+
+// CertValidity is the default validity of the CA and the server certificate.
+const CertValidity = 3650 * 24 * time.Hour
+
+// JWTSecretMinSize is the minimum size in bytes of an HS256 JWT secret.
+const JWTSecretMinSize = 32
+
+// AuthFailureThreshold is the number of failed auths, from one IP or against
+// one identity, tolerated before it is locked out.
+const AuthFailureThreshold = 5
+
+// AuthLockoutBase is the first lockout, it doubles with every further failure.
+const AuthLockoutBase = 1 * time.Second
+
+// AuthLockoutMax is the longest lockout.
+const AuthLockoutMax = 1 * time.Hour
+
+// AuthFailureWindow is how long failed auths are remembered.
+const AuthFailureWindow = 15 * time.Minute
+
+// AuthPruneInterval is how often forgotten failed auths are pruned.
+const AuthPruneInterval = 1 * time.Minute
+
+// UpgradeTimeout is how long a new process started by an upgrade is waited
+// for to be ready, it is killed afterwards and the old process keeps running.
+const UpgradeTimeout = 30 * time.Second
+
+// ShutdownPollInterval is how often the active sessions are checked while
+// draining them.
+const ShutdownPollInterval = 100 * time.Millisecond
+
+// UsageFlushInterval is how often the traffic usage is persisted and the
+// quotas of agents are enforced.
+const UsageFlushInterval = 10 * time.Second
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/easzlab/ezvpn/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// ApproveCN adds cn to the approved CNs of the named agent in the allowed
+// agents file, keeping the rest of the file and its comments as they are.
+// When there is no such agent, an entry with a new auth key is added and the
+// plaintext key is returned; only its hash is written to the file.
+func ApproveCN(file, name, cn string) (string, error) {
+	var key string
+	err := editAgent(file, name, func(entry *yaml.Node, created bool) error {
+		if created {
+			var err error
+			if key, err = setAuthKey(entry); err != nil {
+				return err
+			}
+		}
+		approveCN(entry, cn)
+		return nil
+	})
+	return key, err
+}
+
+// ErrAgentExists is returned when enrolling an agent which already exists.
+var ErrAgentExists = errors.New("agent already exists")
+
+// EnrollAgent is like ApproveCN, but always gives the agent a new auth key.
+// An existing agent is refused with ErrAgentExists unless replace is set, its
+// auth key is replaced then. The plaintext key is returned.
+func EnrollAgent(file, name, cn string, replace bool) (string, error) {
+	var key string
+	err := editAgent(file, name, func(entry *yaml.Node, created bool) error {
+		if !created && !replace {
+			return fmt.Errorf("%s: %w", name, ErrAgentExists)
+		}
+		var err error
+		if key, err = setAuthKey(entry); err != nil {
+			return err
+		}
+		approveCN(entry, cn)
+		return nil
+	})
+	return key, err
+}
+
+// editAgent applies fn to the entry of the named agent in the allowed agents
+// file, an empty entry is created when there is no such agent.
+func editAgent(file, name string, fn func(entry *yaml.Node, created bool) error) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: expect a mapping at the top level", file)
+	}
+
+	agents := mappingValue(doc.Content[0], "agents")
+	if agents == nil {
+		agents = &yaml.Node{Kind: yaml.SequenceNode}
+		doc.Content[0].Content = append(doc.Content[0].Content, scalar("agents"), agents)
+	}
+
+	entry := findAgent(agents, name)
+	created := entry == nil
+	if created {
+		entry = &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{scalar("name"), scalar(name)}}
+		agents.Content = append(agents.Content, entry)
+	}
+	if err := fn(entry, created); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+
+	// replace the file at once, so that a hot reload never sees half of it,
+	// keeping its mode as the file holds auth keys
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	// WriteFile applies the umask, and leaves the mode of an existing file
+	if err := os.Chmod(tmp, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// setAuthKey sets a new auth key in entry, and returns it in plaintext.
+func setAuthKey(entry *yaml.Node) (string, error) {
+	key, err := auth.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	hash, err := auth.HashKey(key, auth.SchemeArgon2id)
+	if err != nil {
+		return "", err
+	}
+
+	if n := mappingValue(entry, "auth_key"); n != nil {
+		n.Value, n.Tag, n.Style = hash, "!!str", 0
+	} else {
+		entry.Content = append(entry.Content, scalar("auth_key"), scalar(hash))
+	}
+	return key, nil
+}
+
+// approveCN adds cn to the approved CNs of entry unless it is already there.
+func approveCN(entry *yaml.Node, cn string) {
+	cns := mappingValue(entry, "approved_cns")
+	if cns == nil {
+		cns = &yaml.Node{Kind: yaml.SequenceNode}
+		entry.Content = append(entry.Content, scalar("approved_cns"), cns)
+	}
+	for _, n := range cns.Content {
+		if n.Value == cn {
+			return
+		}
+	}
+	cns.Content = append(cns.Content, scalar(cn))
+}
+
+// findAgent returns the entry of the named agent in the agents sequence.
+func findAgent(agents *yaml.Node, name string) *yaml.Node {
+	for _, entry := range agents.Content {
+		if n := mappingValue(entry, "name"); n != nil && n.Value == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value of key in mapping node m.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// scalar returns a string scalar node.
+func scalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is a range of ports, both ends included.
+type PortRange struct {
+	Low, High int
+}
+
+// Contains reports whether port is in r.
+func (r PortRange) Contains(port int) bool {
+	return r.Low <= port && port <= r.High
+}
+
+// ParsePorts parses ports and port ranges like `80`, `5432` or `8000-8999`.
+func ParsePorts(list []string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, s := range list {
+		low, high, found := strings.Cut(strings.TrimSpace(s), "-")
+		if !found {
+			high = low
+		}
+		l, lerr := strconv.Atoi(low)
+		h, herr := strconv.Atoi(high)
+		if lerr != nil || herr != nil || l < 1 || h > 65535 || l > h {
+			return nil, fmt.Errorf("invalid port range %q", s)
+		}
+		ranges = append(ranges, PortRange{l, h})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		in      []string
+		want    []PortRange
+		wantErr bool
+	}{
+		{nil, nil, false},
+		{[]string{"80"}, []PortRange{{80, 80}}, false},
+		{[]string{"80", "8000-8999"}, []PortRange{{80, 80}, {8000, 8999}}, false},
+		{[]string{" 5432 "}, []PortRange{{5432, 5432}}, false},
+		{[]string{"1-65535"}, []PortRange{{1, 65535}}, false},
+		{[]string{"0"}, nil, true},
+		{[]string{"65536"}, nil, true},
+		{[]string{"9000-8000"}, nil, true},
+		{[]string{"http"}, nil, true},
+		{[]string{"80-"}, nil, true},
+		{[]string{""}, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePorts(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePorts(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePorts(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
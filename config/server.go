@@ -1,9 +1,15 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
-	"log"
+	"os"
+	"time"
 
+	"github.com/easzlab/ezvpn/auth"
+	"github.com/easzlab/ezvpn/logging"
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
@@ -12,59 +18,214 @@ import (
 type Server struct {
 	EnableTLS      bool
 	EnablePprof    bool
+	LegacyAuth     bool
 	ControlAddress string
 	ConfigFile     string
 	CaFile         string
 	CertFile       string
 	KeyFile        string
 	SocksServer    string
+	CADir          string
+	EnrollTokens   string
+	CRLFiles       []string
+	AdminAddress   string
+	RateLimit      string
+	UsageFile      string
+	// AuditLog is the file connections are recorded to, `-` is stdout.
+	AuditLog        string
+	AuditLogMaxSize string
+	AuditLogBackups int
+	// DrainTimeout is how long active sessions are waited for on shutdown.
+	DrainTimeout   time.Duration
+	AuthAllowlist  []string
+	TrustedProxies []string
+	// MuxAddress is where agents connect with the mux transport, it is
+	// disabled when empty.
+	MuxAddress string
+	// QUICAddress is the UDP address agents connect to with the QUIC
+	// transport, it is disabled when empty.
+	QUICAddress string
+	// EnrollAddress is where agents enroll when CADir is set.
+	EnrollAddress string
+}
+
+// Agent is the configuration of an allowed agent. AuthKey is either the
+// plaintext key or its argon2id, bcrypt or sha256 hash.
+type Agent struct {
+	Name                string   `mapstructure:"name"`
+	AuthKey             string   `mapstructure:"auth_key"`
+	ApprovedCNs         []string `mapstructure:"approved_cns"`
+	ApprovedSANs        []string `mapstructure:"approved_sans"`
+	ApprovedURIs        []string `mapstructure:"approved_uris"`
+	ApprovedIssuers     []string `mapstructure:"approved_issuers"`
+	Fingerprint         string   `mapstructure:"fingerprint"`
+	Groups              []string `mapstructure:"groups"`
+	AllowedDestinations []string `mapstructure:"allowed_destinations"`
+	// RateLimit limits both directions, UploadRateLimit (agent to
+	// destination) and DownloadRateLimit override it, e.g. `20Mbit`.
+	RateLimit         string `mapstructure:"rate_limit"`
+	UploadRateLimit   string `mapstructure:"upload_rate_limit"`
+	DownloadRateLimit string `mapstructure:"download_rate_limit"`
+	// DailyQuota and MonthlyQuota limit the traffic of both directions per
+	// calendar day and month, e.g. `10GB`.
+	DailyQuota   string `mapstructure:"daily_quota"`
+	MonthlyQuota string `mapstructure:"monthly_quota"`
+	// MaxSessions caps the concurrent sessions and MaxNewSessionsPerSecond
+	// the rate of new sessions, 0 is unlimited.
+	MaxSessions             int     `mapstructure:"max_sessions"`
+	MaxNewSessionsPerSecond float64 `mapstructure:"max_new_sessions_per_second"`
+	// Compression negotiates permessage-deflate for the sessions of the
+	// agent, when the agent asks for it as well. CompressPorts, when set,
+	// only compresses the traffic sent to the agent from these destination
+	// ports or port ranges, e.g. `80` or `8000-8999`.
+	Compression   bool     `mapstructure:"compression"`
+	CompressPorts []string `mapstructure:"compress_ports"`
+
+	// KeyID and Expires are set for agents authenticated by a JWT, they are
+	// the signing key and the expiry of the token.
+	KeyID   string    `mapstructure:"-"`
+	Expires time.Time `mapstructure:"-"`
+}
+
+// JWTKey is a key used to verify JWT agent credentials. Secret, or the content
+// of KeyFile, is the shared secret for HS256. For EdDSA, KeyFile is the PEM
+// encoded ed25519 public key.
+type JWTKey struct {
+	ID        string `mapstructure:"id"`
+	Algorithm string `mapstructure:"alg"`
+	Secret    string `mapstructure:"secret"`
+	KeyFile   string `mapstructure:"key_file"`
+
+	// Key is the verification key, loaded once when the config is loaded.
+	Key interface{} `mapstructure:"-"`
+}
+
+// VerificationKey reads the key verifying tokens signed with k: the secret
+// for HS256, which must be at least JWTSecretMinSize bytes long, or the
+// ed25519 public key for EdDSA.
+func (k JWTKey) VerificationKey() (interface{}, error) {
+	switch k.Algorithm {
+	case "HS256":
+		secret := []byte(k.Secret)
+		if k.Secret == "" && k.KeyFile != "" {
+			data, err := os.ReadFile(k.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			secret = data
+		}
+		if len(secret) < JWTSecretMinSize {
+			return nil, fmt.Errorf("secret of jwt key %s is shorter than %d bytes", k.ID, JWTSecretMinSize)
+		}
+		return secret, nil
+	case "EdDSA":
+		if k.KeyFile == "" {
+			return nil, fmt.Errorf("empty key file of jwt key %s", k.ID)
+		}
+		data, err := os.ReadFile(k.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in key file of jwt key %s", k.ID)
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key file of jwt key %s is not an ed25519 public key", k.ID)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported alg of jwt key %s: %s", k.ID, k.Algorithm)
 }
 
 // AllowedAgents is the configuration for the allowed agents.
 type AllowedAgents struct {
-	Agents []struct {
-		Name        string   `mapstructure:"name"`
-		AuthKey     string   `mapstructure:"auth_key"`
-		ApprovedCNs []string `mapstructure:"approved_cns"`
-	}
+	Agents  []Agent
+	Groups  []Group  `mapstructure:"groups"`
+	JWTKeys []JWTKey `mapstructure:"jwt_keys"`
 }
 
+// Group grants its allowed destinations to the agents naming it in their
+// groups, configured agents as well as the groups claim of a JWT.
+type Group struct {
+	Name                string   `mapstructure:"name"`
+	AllowedDestinations []string `mapstructure:"allowed_destinations"`
+}
+
+// logger is the logger of the config component.
+var logger = logging.Component(logging.Config)
+
 var AGENTS, AGENTS_TMP AllowedAgents
 var SERVER Server
 
+// reloadHooks are called after the allowed agents are reloaded.
+var reloadHooks []func()
+
+// OnReload registers fn to be called after the allowed agents are reloaded.
+func OnReload(fn func()) {
+	reloadHooks = append(reloadHooks, fn)
+}
+
 func (server *Server) HotReload() {
 	var err error
 	s := viper.New()
 	s.SetConfigFile(server.ConfigFile)
 
 	if err = s.ReadInConfig(); err != nil {
-		log.Panic(err)
+		logger.Error("failed to read the config", "file", server.ConfigFile, "error", err)
+		os.Exit(1)
 	}
 	if err = s.Unmarshal(&AGENTS); err != nil {
-		log.Panic(err)
+		logger.Error("failed to parse the config", "file", server.ConfigFile, "error", err)
+		os.Exit(1)
+	}
+	if err = check(&AGENTS); err != nil {
+		logger.Error("invalid config", "file", server.ConfigFile, "error", err)
+		os.Exit(1)
 	}
-	//fmt.Println("1: ", AGENTS)
+	warnPlaintextKeys(&AGENTS)
 
 	s.WatchConfig()
 
 	s.OnConfigChange(func(e fsnotify.Event) {
-		log.Printf("Config file changed: %s, reload it.", e.Name)
+		logger.Info("config file changed, reload it", "file", e.Name)
 		AGENTS_TMP = AllowedAgents{}
 		if err := s.Unmarshal(&AGENTS_TMP); err != nil {
-			log.Println(err)
+			logger.Error("failed to parse the config", "file", e.Name, "error", err)
 		} else {
 			if err := check(&AGENTS_TMP); err != nil {
-				log.Println(err)
+				logger.Error("invalid config, keep using the current one", "file", e.Name, "error", err)
 			} else {
 				// here we can reload the config safely
 				AGENTS = AGENTS_TMP
-				fmt.Println("2: ", AGENTS)
+				warnPlaintextKeys(&AGENTS)
+				logger.Info("allowed agents loaded", "agents", len(AGENTS.Agents))
+				for _, fn := range reloadHooks {
+					fn()
+				}
 			}
 		}
 	})
 }
 
-// basic check for the config
+// LoadAgents reads the allowed agents from file once, without watching it.
+func LoadAgents(file string) (AllowedAgents, error) {
+	var agents AllowedAgents
+	s := viper.New()
+	s.SetConfigFile(file)
+	if err := s.ReadInConfig(); err != nil {
+		return agents, err
+	}
+	err := s.Unmarshal(&agents)
+	return agents, err
+}
+
+// basic check for the config, which also loads the JWT keys
 func check(a *AllowedAgents) error {
 	if a == nil {
 		return fmt.Errorf("nil pointer")
@@ -73,9 +234,53 @@ func check(a *AllowedAgents) error {
 		if agent.AuthKey == "" {
 			return fmt.Errorf("empty auth key")
 		}
-		if len(agent.ApprovedCNs) == 0 {
-			return fmt.Errorf("empty approved CNs")
+		if len(agent.ApprovedCNs) == 0 && len(agent.ApprovedSANs) == 0 && len(agent.ApprovedURIs) == 0 {
+			return fmt.Errorf("empty approved CNs, SANs and URIs")
+		}
+		for _, r := range []string{agent.RateLimit, agent.UploadRateLimit, agent.DownloadRateLimit} {
+			if _, err := ParseRate(r); err != nil {
+				return err
+			}
+		}
+		for _, q := range []string{agent.DailyQuota, agent.MonthlyQuota} {
+			if _, err := ParseSize(q); err != nil {
+				return err
+			}
+		}
+		if _, err := ParsePorts(agent.CompressPorts); err != nil {
+			return err
 		}
+		if agent.MaxSessions < 0 || agent.MaxNewSessionsPerSecond < 0 {
+			return fmt.Errorf("negative session limit of agent %s", agent.Name)
+		}
+	}
+	groups := map[string]bool{}
+	for _, group := range a.Groups {
+		if group.Name == "" {
+			return fmt.Errorf("empty group name")
+		}
+		if groups[group.Name] {
+			return fmt.Errorf("duplicate group %s", group.Name)
+		}
+		groups[group.Name] = true
+	}
+	// the keys are read here, so that tokens are not verified against a
+	// short secret nor the key files read on every verification
+	for i := range a.JWTKeys {
+		key, err := a.JWTKeys[i].VerificationKey()
+		if err != nil {
+			return err
+		}
+		a.JWTKeys[i].Key = key
 	}
 	return nil
 }
+
+// warnPlaintextKeys logs the agents whose auth key is not hashed.
+func warnPlaintextKeys(a *AllowedAgents) {
+	for _, agent := range a.Agents {
+		if !auth.IsHashed(agent.AuthKey) {
+			logger.Warn("plaintext auth key, consider storing its hash instead", "agent", agent.Name)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// rateUnits are the units of a rate in bytes per second. Units are case
+// sensitive: `bit` and `bps` units are decimal bits, `B` units binary bytes,
+// which may be followed by `/s`.
+var rateUnits = map[string]float64{
+	"bit":  1.0 / 8,
+	"Kbit": 1e3 / 8,
+	"kbit": 1e3 / 8,
+	"Mbit": 1e6 / 8,
+	"Gbit": 1e9 / 8,
+	"bps":  1.0 / 8,
+	"Kbps": 1e3 / 8,
+	"kbps": 1e3 / 8,
+	"Mbps": 1e6 / 8,
+	"Gbps": 1e9 / 8,
+	"B":    1,
+	"KB":   1 << 10,
+	"KiB":  1 << 10,
+	"MB":   1 << 20,
+	"MiB":  1 << 20,
+	"GB":   1 << 30,
+	"GiB":  1 << 30,
+}
+
+// ParseRate parses a rate like `20Mbit`, `20Mbps` or `5MB` (per second) into
+// bytes per second. An empty rate is 0, which means unlimited.
+func ParseRate(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	value, unit := splitUnit(s)
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %v", s, err)
+	}
+	if strings.HasSuffix(unit, "B/s") {
+		unit = strings.TrimSuffix(unit, "/s")
+	}
+	factor, ok := rateUnits[unit]
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n * factor, nil
+}
+
+// splitUnit splits `20Mbit` into `20` and `Mbit`.
+func splitUnit(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// sizeUnits are the binary units of a size in bytes, they are case sensitive.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1 << 10,
+	"KiB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1 << 20,
+	"MiB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1 << 30,
+	"GiB": 1 << 30,
+	"T":   1 << 40,
+	"TB":  1 << 40,
+	"TiB": 1 << 40,
+}
+
+// ParseSize parses a size like `10GB` into bytes. An empty size is 0, which
+// means unlimited.
+func ParseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	value, unit := splitUnit(s)
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	factor, ok := sizeUnits[unit]
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(factor)), nil
+}
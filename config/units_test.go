@@ -0,0 +1,85 @@
+package config
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"800bit", 100, false},
+		{"8Kbit", 1e3, false},
+		{"8kbit", 1e3, false},
+		{"20Mbit", 2.5e6, false},
+		{"1Gbit", 1.25e8, false},
+		{"800bps", 100, false},
+		{"8Kbps", 1e3, false},
+		{"20Mbps", 2.5e6, false},
+		{"1Gbps", 1.25e8, false},
+		{"1.5Mbps", 1.875e5, false},
+		{"100B", 100, false},
+		{"5MB", 5 << 20, false},
+		{"5MB/s", 5 << 20, false},
+		{"5MiB", 5 << 20, false},
+		{"1GB", 1 << 30, false},
+		{" 5 MB ", 5 << 20, false},
+		{"5mb", 0, true},
+		{"20mbps", 0, true},
+		{"20MBps", 0, true},
+		{"20Mbit/s", 0, true},
+		{"5", 0, true},
+		{"5XB", 0, true},
+		{"-5MB", 0, true},
+		{"MB", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRate(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"100", 100, false},
+		{"100B", 100, false},
+		{"1K", 1 << 10, false},
+		{"1KB", 1 << 10, false},
+		{"1KiB", 1 << 10, false},
+		{"10MB", 10 << 20, false},
+		{"1.5GB", 3 << 29, false},
+		{"10G", 10 << 30, false},
+		{"2TB", 2 << 40, false},
+		{" 2 TB ", 2 << 40, false},
+		{"10gb", 0, true},
+		{"10Gb", 0, true},
+		{"10mb", 0, true},
+		{"10XB", 0, true},
+		{"-1GB", 0, true},
+		{"GB", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSize(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package control
+
+// EnrollRequest is posted by a new agent to the `/enroll` endpoint.
+type EnrollRequest struct {
+	// Token is the single-use bootstrap token.
+	Token string `json:"token"`
+	// CSR is the PEM encoded certificate signing request of the agent.
+	CSR string `json:"csr"`
+}
+
+// EnrollResponse is returned to an enrolled agent.
+type EnrollResponse struct {
+	Name string `json:"name"`
+	// Certificate is the PEM encoded client certificate of the agent.
+	Certificate string `json:"certificate"`
+	// CA is the PEM encoded CA bundle.
+	CA string `json:"ca"`
+	// AuthKey is the auth key of the agent.
+	AuthKey string `json:"auth_key"`
+}
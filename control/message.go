@@ -0,0 +1,25 @@
+package control
+
+import "time"
+
+// Message types sent by the server to the agent over the control channel.
+const (
+	// TypeTicket carries a new session ticket.
+	TypeTicket = "ticket"
+	// TypeShutdown tells the server is going away, the control channel is
+	// closed once the sessions are drained.
+	TypeShutdown = "shutdown"
+)
+
+// HeaderAgentName is the request header naming the allowed agent an auth key
+// belongs to, so that the server verifies the key against that agent only.
+const HeaderAgentName = "Agent-Name"
+
+// Message is a control message, sent as a JSON text frame over the control
+// channel.
+type Message struct {
+	Type    string    `json:"type"`
+	Ticket  string    `json:"ticket,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
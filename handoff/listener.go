@@ -0,0 +1,283 @@
+package handoff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/easzlab/ezvpn/logging"
+)
+
+// logger is the logger of the handoff, part of the server component.
+var logger = logging.Component(logging.Server)
+
+// EnvListeners names the listeners passed to a new process on upgrade, in
+// the order of their file descriptors starting at 3.
+const EnvListeners = "EZVPN_LISTENERS"
+
+// EnvState is the file descriptor of the state passed to a new process on
+// upgrade, see SetState.
+const EnvState = "EZVPN_STATE"
+
+// EnvReady is the file descriptor a new process reports being ready on, see
+// Ready.
+const EnvReady = "EZVPN_READY"
+
+// EnvFinalState is the file descriptor of the state passed to a new process
+// once the parent process is drained, see SetFinalState.
+const EnvFinalState = "EZVPN_FINAL_STATE"
+
+// listenFdsStart is the first file descriptor passed by systemd or a parent
+// process, after stdin, stdout and stderr.
+const listenFdsStart = 3
+
+var (
+	mu sync.Mutex
+	// inherited are the sockets not yet taken by Listen or ListenPacket.
+	inherited map[string]*os.File
+	// active are the listeners in use, passed on upgrade.
+	active = map[string]net.Listener{}
+	// names keeps the order the sockets were opened in.
+	names []string
+
+	// state is passed to a new process, inheritedState was passed by the
+	// parent process.
+	state          = map[string][]byte{}
+	inheritedState map[string][]byte
+
+	// finalState is passed to the new process on final once drained.
+	finalState = map[string][]byte{}
+	final      *os.File
+
+	// inheritedFinal is the final state passed by the parent process, read
+	// once by the first call of FinalState.
+	finalOnce      sync.Once
+	inheritedFinal map[string][]byte
+)
+
+// Listen returns the listener called name, inherited from the parent process
+// or systemd socket activation, or a new TCP listener on addr.
+func Listen(name, addr string) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, err := take(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var l net.Listener
+	if f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %s: %v", name, err)
+		}
+		logger.Info("listener inherited", "name", name, "address", l.Addr().String())
+	} else if l, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+
+	active[name] = l
+	names = append(names, name)
+	return l, nil
+}
+
+// ListenPacket returns the packet conn called name, inherited from systemd
+// socket activation, or a new UDP conn on addr. Unlike the listeners it is
+// neither passed on upgrade nor closed by Close: the new process binds its
+// own with SO_REUSEPORT, and the owner closes this one once its connections
+// are drained.
+func ListenPacket(name, addr string) (net.PacketConn, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, err := take(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.PacketConn
+	if f != nil {
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited packet conn %s: %v", name, err)
+		}
+		logger.Info("packet conn inherited", "name", name, "address", conn.LocalAddr().String())
+	} else if conn, err = listenPacket(addr); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// take returns the inherited socket called name, nil if there is none.
+func take(name string) (*os.File, error) {
+	if inherited == nil {
+		var err error
+		if inherited, err = inherit(); err != nil {
+			return nil, err
+		}
+	}
+
+	f := inherited[name]
+	delete(inherited, name)
+	return f, nil
+}
+
+// inherit returns the sockets passed by the parent process, or by systemd
+// with LISTEN_FDS, named by LISTEN_FDNAMES (FileDescriptorName= in the
+// socket unit).
+func inherit() (map[string]*os.File, error) {
+	var list []string
+	if env := os.Getenv(EnvListeners); env != "" {
+		list = strings.Split(env, ",")
+		os.Unsetenv(EnvListeners)
+	} else if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid LISTEN_FDS: %v", err)
+		}
+		list = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		if len(list) != n {
+			return nil, fmt.Errorf("LISTEN_FDNAMES does not name all of the %d sockets", n)
+		}
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}
+
+	files := map[string]*os.File{}
+	for i, name := range list {
+		files[name] = os.NewFile(uintptr(listenFdsStart+i), name)
+	}
+	return files, nil
+}
+
+// Close closes the active listeners, the new process keeps accepting on its
+// copies of them.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, l := range active {
+		l.Close()
+	}
+}
+
+// SetState sets the state called name, which is passed to a new process on
+// upgrade.
+func SetState(name string, data []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	state[name] = data
+}
+
+// State returns the state called name passed by the parent process, nil if
+// there is none.
+func State(name string) []byte {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if inheritedState == nil {
+		inheritedState = map[string][]byte{}
+		if f := inheritedFile(EnvState); f != nil {
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err == nil {
+				err = json.Unmarshal(data, &inheritedState)
+			}
+			if err != nil {
+				logger.Warn("failed to read the inherited state", "error", err)
+			}
+		}
+	}
+	return inheritedState[name]
+}
+
+// SetFinalState sets the state called name, which is passed to the new
+// process started by an upgrade once this one is drained, see Finish.
+func SetFinalState(name string, data []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	finalState[name] = data
+}
+
+// Finish passes the final state to the new process, once this one is
+// drained and about to exit. It does nothing unless upgraded.
+func Finish() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if final == nil {
+		return nil
+	}
+	defer func() {
+		final.Close()
+		final = nil
+	}()
+	data, err := json.Marshal(finalState)
+	if err != nil {
+		return err
+	}
+	_, err = final.Write(data)
+	return err
+}
+
+// FinalState returns the state called name passed by the parent process with
+// Finish, it blocks until the parent is drained. It is nil when not started
+// by an upgrade, or when the parent exited without passing it.
+func FinalState(name string) []byte {
+	finalOnce.Do(func() {
+		mu.Lock()
+		f := inheritedFile(EnvFinalState)
+		mu.Unlock()
+
+		inheritedFinal = map[string][]byte{}
+		if f == nil {
+			return
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err == nil && len(data) > 0 {
+			err = json.Unmarshal(data, &inheritedFinal)
+		}
+		if err != nil {
+			logger.Warn("failed to read the final state of the parent process", "error", err)
+		}
+	})
+	return inheritedFinal[name]
+}
+
+// Ready tells the parent process that this one is ready once it listens on
+// all of its sockets, the parent then stops accepting and drains. Under
+// systemd, it tells it too along with the PID of this process, which becomes
+// the main process of the service in place of the parent.
+func Ready() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if f := inheritedFile(EnvReady); f != nil {
+		f.Write([]byte{1})
+		f.Close()
+	}
+	if err := notify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		logger.Warn("failed to notify systemd", "error", err)
+	}
+}
+
+// inheritedFile returns the file whose descriptor is in the environment
+// variable env, nil if there is none.
+func inheritedFile(env string) *os.File {
+	fd, err := strconv.Atoi(os.Getenv(env))
+	os.Unsetenv(env)
+	if err != nil || fd < listenFdsStart {
+		return nil
+	}
+	return os.NewFile(uintptr(fd), env)
+}
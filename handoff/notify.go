@@ -0,0 +1,28 @@
+package handoff
+
+import (
+	"net"
+	"os"
+)
+
+// notify sends state to systemd as sd_notify does, when started by a service
+// of Type=notify. The new process of an upgrade is not the one started by
+// systemd, the service needs NotifyAccess=all.
+func notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// abstract sockets are named with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package handoff
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenPacket returns a new UDP conn on addr, bound with SO_REUSEPORT so
+// that a new process started on upgrade binds its own while this one drains.
+func listenPacket(addr string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	return lc.ListenPacket(context.Background(), "udp", addr)
+}
@@ -0,0 +1,9 @@
+package handoff
+
+import "net"
+
+// listenPacket returns a new UDP conn on addr, upgrades are not supported on
+// windows.
+func listenPacket(addr string) (net.PacketConn, error) {
+	return net.ListenPacket("udp", addr)
+}
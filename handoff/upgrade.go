@@ -0,0 +1,119 @@
+//go:build !windows
+
+package handoff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// NotifyUpgrade relays SIGUSR2, which asks for an upgrade, to c.
+func NotifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// Upgrade starts a new process of the current executable, with the same
+// arguments, which inherits the active listeners and the state. It returns
+// the PID of the new process once it is ready, the caller is expected to stop
+// accepting, drain and Finish. A new process not ready within timeout is
+// killed.
+func Upgrade(timeout time.Duration) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	mu.Lock()
+	var files []*os.File
+	for _, name := range names {
+		l, ok := active[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			mu.Unlock()
+			return 0, fmt.Errorf("listener %s can not be passed on", name)
+		}
+		f, err := l.File()
+		if err != nil {
+			mu.Unlock()
+			return 0, err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	data, err := json.Marshal(state)
+	mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// the state is read from a pipe, small enough to fit in its buffer
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer stateR.Close()
+	_, err = stateW.Write(data)
+	stateW.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// the new process writes to the other pipe once it is ready
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+	defer readyW.Close()
+
+	// and reads the final state from the last one until this process
+	// finishes, or exits
+	finalR, finalW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer finalR.Close()
+
+	env := append(os.Environ(),
+		EnvListeners+"="+strings.Join(names, ","),
+		EnvState+"="+strconv.Itoa(listenFdsStart+len(files)),
+		EnvReady+"="+strconv.Itoa(listenFdsStart+len(files)+1),
+		EnvFinalState+"="+strconv.Itoa(listenFdsStart+len(files)+2),
+	)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, stateR, readyW, finalR)
+	if err := cmd.Start(); err != nil {
+		finalW.Close()
+		return 0, err
+	}
+	// reap the new process should it exit before this one
+	go cmd.Wait()
+
+	// only the new process holds the write end now, reading fails once it
+	// exits without being ready
+	readyW.Close()
+	readyR.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		finalW.Close()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, fmt.Errorf("new process %d not ready within %s", cmd.Process.Pid, timeout)
+		}
+		return 0, fmt.Errorf("new process %d exited before being ready", cmd.Process.Pid)
+	}
+
+	mu.Lock()
+	final = finalW
+	mu.Unlock()
+	return cmd.Process.Pid, nil
+}
@@ -0,0 +1,179 @@
+//go:build !windows
+
+package handoff
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envChild tells the test binary to run as the new process of an upgrade:
+// serve, exit, or hang.
+const envChild = "EZVPN_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(envChild) {
+	case "":
+		os.Exit(m.Run())
+	case "serve":
+		serveChild()
+	case "exit":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+	}
+	os.Exit(0)
+}
+
+// serveChild takes over the listener called test, answers the first
+// connection with the state called greeting and the second one with the final
+// state called final, then exits.
+func serveChild() {
+	l, err := Listen("test", "127.0.0.1:0")
+	if err != nil {
+		os.Exit(2)
+	}
+	greeting := State("greeting")
+	Ready()
+
+	for _, reply := range []func() []byte{
+		func() []byte { return greeting },
+		func() []byte { return FinalState("final") },
+	} {
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(3)
+		}
+		conn.Write(reply())
+		conn.Close()
+	}
+}
+
+// resetListeners forgets the listeners of the test, which are passed on by
+// the next upgrade otherwise.
+func resetListeners(t *testing.T) {
+	t.Cleanup(func() {
+		Close()
+		mu.Lock()
+		defer mu.Unlock()
+		active = map[string]net.Listener{}
+		names = nil
+	})
+}
+
+func TestUpgrade(t *testing.T) {
+	resetListeners(t)
+
+	// systemd is told the new process is the main one
+	socket := filepath.Join(t.TempDir(), "notify")
+	notified, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notified.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	l, err := Listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetState("greeting", []byte("hello"))
+
+	t.Setenv(envChild, "serve")
+	pid, err := Upgrade(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+
+	buf := make([]byte, 128)
+	notified.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := notified.Read(buf)
+	if err != nil {
+		t.Fatalf("no notification: %v", err)
+	}
+	if got, want := string(buf[:n]), fmt.Sprintf("READY=1\nMAINPID=%d", pid); got != want {
+		t.Fatalf("notification = %q, want %q", got, want)
+	}
+
+	// this process stops accepting, the new one accepts on the same socket
+	Close()
+	read := func() string {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if got := read(); got != "hello" {
+		t.Fatalf("new process answered %q, want the state hello", got)
+	}
+
+	// the final state is passed once this process is drained
+	SetFinalState("final", []byte("bye"))
+	if err := Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if got := read(); got != "bye" {
+		t.Fatalf("new process answered %q, want the final state bye", got)
+	}
+}
+
+func TestUpgradeFailed(t *testing.T) {
+	resetListeners(t)
+
+	l, err := Listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		child   string
+		timeout time.Duration
+		want    string
+	}{
+		{"exit", 10 * time.Second, "exited before being ready"},
+		{"hang", 500 * time.Millisecond, "not ready within"},
+	}
+
+	for _, tt := range tests {
+		t.Setenv(envChild, tt.child)
+		if _, err := Upgrade(tt.timeout); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Upgrade error = %v, want %q", tt.child, err, tt.want)
+		}
+		// nothing is passed to the failed process
+		if err := Finish(); err != nil {
+			t.Errorf("%s: Finish: %v", tt.child, err)
+		}
+	}
+
+	// this process keeps accepting
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Fatalf("listener not usable after the failed upgrades: %v", err)
+	}
+}
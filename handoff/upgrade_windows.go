@@ -0,0 +1,15 @@
+package handoff
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// NotifyUpgrade does nothing, upgrades are not supported on windows.
+func NotifyUpgrade(c chan<- os.Signal) {}
+
+// Upgrade is not supported on windows.
+func Upgrade(timeout time.Duration) (int, error) {
+	return 0, errors.New("upgrade is not supported on windows")
+}
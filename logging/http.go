@@ -0,0 +1,33 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler serves the log levels, so that they can be switched at runtime:
+// GET lists them, and PUT or POST with the `level` and optional `component`
+// query parameters sets one, e.g. `?component=socks&level=debug`. Without a
+// component, the default level is set.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			q := r.URL.Query()
+			if err := SetLevel(q.Get("component"), q.Get("level")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			Component(Main).Info("log level changed", "of", q.Get("component"), "level", q.Get("level"))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(Levels())
+	})
+}
@@ -0,0 +1,187 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Components have their own log level.
+const (
+	Server    = "server"
+	Agent     = "agent"
+	Socks     = "socks"
+	Config    = "config"
+	PKI       = "pki"
+	HTTP      = "http"
+	Transport = "transport"
+	Main      = "main"
+)
+
+// Components is the list of all components.
+var Components = []string{Server, Agent, Socks, Config, PKI, HTTP, Transport, Main}
+
+var (
+	// output is the handler all components write to, replaced by Setup.
+	output atomic.Pointer[slog.Handler]
+	// level is the level of components without their own.
+	level slog.LevelVar
+	// levels are the levels set per component.
+	levels sync.Map
+)
+
+func init() {
+	setOutput(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	slog.SetDefault(Component(Main))
+}
+
+// Setup configures logging: format is `text` or `json`, defaultLevel is the
+// level of all components, and componentLevels overrides it per component
+// like `socks=debug,http=warn`.
+func Setup(w io.Writer, format, defaultLevel, componentLevels string) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format {
+	case "text", "":
+		setOutput(slog.NewTextHandler(w, opts))
+	case "json":
+		setOutput(slog.NewJSONHandler(w, opts))
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	if err := SetLevel("", defaultLevel); err != nil {
+		return err
+	}
+	for _, item := range strings.Split(componentLevels, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		component, lvl, found := strings.Cut(item, "=")
+		if !found {
+			return fmt.Errorf("invalid component log level %q, expect component=level", item)
+		}
+		if err := SetLevel(component, lvl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLevel sets the level of component, or of all components without their
+// own level when component is empty.
+func SetLevel(component, lvl string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return err
+	}
+
+	if component == "" {
+		level.Set(l)
+		return nil
+	}
+	if !known(component) {
+		return fmt.Errorf("unknown log component %q", component)
+	}
+	v, _ := levels.LoadOrStore(component, &slog.LevelVar{})
+	v.(*slog.LevelVar).Set(l)
+	return nil
+}
+
+// Levels returns the current level of every component, and the default one.
+func Levels() map[string]string {
+	current := map[string]string{"default": level.Level().String()}
+	for _, component := range Components {
+		current[component] = levelOf(component).String()
+	}
+	return current
+}
+
+// Component returns the logger of component. Its records carry a
+// `component` attribute and are dropped below the level of component.
+func Component(name string) *slog.Logger {
+	return slog.New(&handler{component: name}).With("component", name)
+}
+
+// handler filters records by the level of its component and passes them to
+// the current output.
+type handler struct {
+	component string
+	// wrap are the attributes and groups added by With and WithGroup,
+	// applied in order to the output.
+	wrap []func(slog.Handler) slog.Handler
+	// built is the output with wrap applied, built once and again only
+	// after the output is replaced.
+	built atomic.Pointer[builtOutput]
+}
+
+// builtOutput is the output of a handler, built from the output in from.
+type builtOutput struct {
+	from    *slog.Handler
+	handler slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= levelOf(h.component)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	return h.output().Handle(ctx, r)
+}
+
+// output returns the current output with the attributes and groups of h
+// applied, building it when the output was replaced since the last record.
+func (h *handler) output() slog.Handler {
+	current := output.Load()
+	if b := h.built.Load(); b != nil && b.from == current {
+		return b.handler
+	}
+
+	out := *current
+	for _, wrap := range h.wrap {
+		out = wrap(out)
+	}
+	h.built.Store(&builtOutput{from: current, handler: out})
+	return out
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
+
+func (h *handler) with(wrap func(slog.Handler) slog.Handler) *handler {
+	wraps := make([]func(slog.Handler) slog.Handler, len(h.wrap), len(h.wrap)+1)
+	copy(wraps, h.wrap)
+	w := &handler{component: h.component, wrap: append(wraps, wrap)}
+	w.output()
+	return w
+}
+
+func setOutput(h slog.Handler) {
+	output.Store(&h)
+}
+
+// levelOf returns the level of component.
+func levelOf(component string) slog.Level {
+	if v, ok := levels.Load(component); ok {
+		return v.(*slog.LevelVar).Level()
+	}
+	return level.Level()
+}
+
+func known(component string) bool {
+	for _, c := range Components {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// File names of the CA and the server certificate in a CA directory, agent
+// certificates are written to <name>.pem and <name>-key.pem.
+const (
+	CAFile        = "ca.pem"
+	CAKeyFile     = "ca-key.pem"
+	ServerFile    = "server.pem"
+	ServerKeyFile = "server-key.pem"
+)
+
+// agentName is the pattern of agent names, a DNS label since the name is the
+// DNS SAN of the agent certificate.
+var agentName = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// ValidateAgentName checks that name can name an agent certificate. Names of
+// which the certificate files would clash with the files of the CA, such as
+// `ca` or `server`, are refused.
+func ValidateAgentName(name string) error {
+	if !agentName.MatchString(name) {
+		return fmt.Errorf("invalid agent name %q: letters, digits and inner hyphens only, at most 63 characters", name)
+	}
+	for _, file := range []string{CAFile, CAKeyFile, ServerFile, ServerKeyFile, CRLFile} {
+		if file == name+".pem" || file == name+"-key.pem" {
+			return fmt.Errorf("invalid agent name %q: reserved for %s", name, file)
+		}
+	}
+	return nil
+}
+
+// subject is the common part of the subjects of issued certificates.
+var subject = pkix.Name{
+	Organization:       []string{"EASZLAB.COM"},
+	OrganizationalUnit: []string{"EZVPN"},
+}
+
+// InitCA creates a self-signed CA in dir, valid for the given duration. An
+// existing CA is never overwritten.
+func InitCA(dir string, validity time.Duration) error {
+	certFile, keyFile := filepath.Join(dir, CAFile), filepath.Join(dir, CAKeyFile)
+	if _, err := os.Stat(keyFile); err == nil {
+		return fmt.Errorf("CA already exists: %s", keyFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	name := subject
+	name.CommonName = "ezvpn-ca"
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	return writePair(certFile, keyFile, der, key, false)
+}
+
+// LoadCA loads the CA certificate and key from dir.
+func LoadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	cert, err := ReadCertificate(filepath.Join(dir, CAFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("no PEM data in CA key file")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("CA key can not sign")
+	}
+	return cert, signer, nil
+}
+
+// IssueServer issues the server certificate, valid for the given hosts (DNS
+// names or IPs), and writes it to dir.
+func IssueServer(dir string, hosts []string, validity time.Duration) error {
+	ca, caKey, err := LoadCA(dir)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	name := subject
+	name.CommonName = "ezvpn-server"
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return err
+	}
+	return writePair(filepath.Join(dir, ServerFile), filepath.Join(dir, ServerKeyFile), der, key, true)
+}
+
+// IssueAgent issues a client certificate for the named agent and writes it to
+// dir. Both the CN and the DNS SAN of the certificate are set to name. The
+// certificate of an agent is never overwritten, revoke it and remove its
+// files to issue a new one.
+func IssueAgent(dir, name string, validity time.Duration) error {
+	if err := ValidateAgentName(name); err != nil {
+		return err
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	for _, file := range []string{certFile, keyFile} {
+		if _, err := os.Lstat(file); err == nil {
+			return fmt.Errorf("agent cert already exists: %s", file)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	der, err := SignAgent(dir, name, key.Public(), validity)
+	if err != nil {
+		return err
+	}
+	return writePair(certFile, keyFile, der, key, false)
+}
+
+// SignAgent signs a client certificate for the named agent holding the private
+// key of pub, using the CA in dir. It returns the DER encoded certificate.
+func SignAgent(dir, name string, pub crypto.PublicKey, validity time.Duration) ([]byte, error) {
+	if err := ValidateAgentName(name); err != nil {
+		return nil, err
+	}
+	ca, caKey, err := LoadCA(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := subject
+	sub.CommonName = name
+	template, err := newTemplate(sub, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	template.DNSNames = []string{name}
+
+	return x509.CreateCertificate(rand.Reader, template, ca, pub, caKey)
+}
+
+// ReadCertificate reads the first PEM encoded certificate from file.
+func ReadCertificate(file string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// newTemplate returns a certificate template with a random serial number.
+func newTemplate(name pkix.Name, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      name,
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, nil
+}
+
+// writePair writes a DER certificate and its private key as PEM files, the
+// key file is only readable by its owner. Existing files are only replaced
+// when overwrite is set.
+func writePair(certFile, keyFile string, der []byte, key crypto.Signer, overwrite bool) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600, overwrite); err != nil {
+		return err
+	}
+	return writeFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644, overwrite)
+}
+
+// writeFile writes data to file, which must not exist unless overwrite is set.
+func writeFile(file string, data []byte, perm os.FileMode, overwrite bool) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+
+	f, err := os.OpenFile(file, flag, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,170 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CRLFile is the name of the CRL written by Revoke in a CA directory.
+const CRLFile = "crl.pem"
+
+// CRLChecker checks certificates against CRL files, which are reloaded when
+// they change.
+type CRLChecker struct {
+	files []string
+
+	mu   sync.RWMutex
+	crls []*x509.RevocationList
+}
+
+// NewCRLChecker loads the CRL files and starts watching them. onReload is
+// called after the CRLs are reloaded.
+func NewCRLChecker(files []string, onReload func()) (*CRLChecker, error) {
+	c := &CRLChecker{files: files}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	err := WatchFiles(files, func() {
+		if err := c.reload(); err != nil {
+			logger.Error("failed to reload CRLs, keep using the current ones", "error", err)
+			return
+		}
+		logger.Info("CRLs reloaded", "files", files)
+		if onReload != nil {
+			onReload()
+		}
+	})
+	return c, err
+}
+
+// reload loads the CRL files, the current CRLs are kept on failure.
+func (c *CRLChecker) reload() error {
+	var crls []*x509.RevocationList
+	for _, file := range c.files {
+		crl, err := readCRL(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			logger.Warn("CRL is outdated", "file", file, "next_update", crl.NextUpdate)
+		}
+		crls = append(crls, crl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crls = crls
+	return nil
+}
+
+// Revoked reports whether a certificate of the verified chain, which runs
+// from the leaf to the root, is revoked by a CRL signed by its issuer.
+func (c *CRLChecker) Revoked(chain []*x509.Certificate) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range c.crls {
+			if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			for _, revoked := range crl.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// RevokedAny reports whether one of the verified chains is revoked.
+func (c *CRLChecker) RevokedAny(chains [][]*x509.Certificate) bool {
+	for _, chain := range chains {
+		if c.Revoked(chain) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyConnection implements tls.Config.VerifyConnection, it rejects peers
+// whose certificate is revoked. Unlike VerifyPeerCertificate, it also runs on
+// resumed sessions, whose certificate was verified by an earlier handshake.
+func (c *CRLChecker) VerifyConnection(state tls.ConnectionState) error {
+	if c.RevokedAny(state.VerifiedChains) {
+		return fmt.Errorf("certificate %s is revoked", state.PeerCertificates[0].Subject.CommonName)
+	}
+	return nil
+}
+
+// Revoke adds cert to the CRL of the CA in dir, and signs the CRL again. The
+// CRL is valid for the given duration.
+func Revoke(dir string, cert *x509.Certificate, validity time.Duration) error {
+	ca, caKey, err := LoadCA(dir)
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(dir, CRLFile)
+	number := big.NewInt(1)
+	var revoked []pkix.RevokedCertificate
+
+	crl, err := readCRL(file)
+	switch {
+	case err == nil:
+		number.Add(crl.Number, number)
+		revoked = crl.RevokedCertificates
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	for _, r := range revoked {
+		if r.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return fmt.Errorf("certificate %s is already revoked", cert.Subject.CommonName)
+		}
+	}
+	now := time.Now()
+	revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: now})
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              number,
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(validity),
+		RevokedCertificates: revoked,
+	}, ca, caKey)
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// readCRL reads a PEM or DER encoded CRL from file.
+func readCRL(file string) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseRevocationList(data)
+}
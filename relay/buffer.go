@@ -0,0 +1,37 @@
+package relay
+
+import (
+	"sync"
+
+	"github.com/easzlab/ezvpn/config"
+)
+
+// smallBuffers hold the buffers of interactive sessions, largeBuffers those
+// of bulk transfers.
+var (
+	smallBuffers = sync.Pool{New: func() any {
+		b := make([]byte, config.BufferSize)
+		return &b
+	}}
+	largeBuffers = sync.Pool{New: func() any {
+		b := make([]byte, config.MaxMessageSize)
+		return &b
+	}}
+)
+
+// getBuffer returns a pooled buffer, a large one for bulk transfers.
+func getBuffer(large bool) *[]byte {
+	if large {
+		return largeBuffers.Get().(*[]byte)
+	}
+	return smallBuffers.Get().(*[]byte)
+}
+
+// putBuffer returns b to its pool.
+func putBuffer(b *[]byte) {
+	if len(*b) == config.MaxMessageSize {
+		largeBuffers.Put(b)
+		return
+	}
+	smallBuffers.Put(b)
+}
@@ -0,0 +1,126 @@
+// Package relay copies the data of a session between a connection and its
+// stream.
+//
+// Interactive traffic is sent right away, a message per read from a small
+// buffer. Once a read fills the buffer the session is taken for a bulk
+// transfer: reads go to a large buffer and are coalesced, for up to
+// config.CoalesceWait, into messages of up to config.MaxMessageSize, which
+// are streamed as they are read. Streams writing straight through to a byte
+// stream, see transport.Unframed, only get the large buffer.
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/easzlab/ezvpn/compression"
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/transport"
+)
+
+// Send copies conn to s until reading or writing fails. Messages worth it are
+// compressed if compression was negotiated for s. before, when set, is
+// called with the size of every read ahead of writing it, and fails the copy
+// by returning an error.
+func Send(s transport.Stream, conn net.Conn, before func(n int) error) error {
+	buf := getBuffer(false)
+	defer func() { putBuffer(buf) }()
+
+	u, ok := s.(transport.Unframed)
+	coalesce := !ok || !u.Unframed()
+
+	for {
+		n, err := conn.Read(*buf)
+		if n > 0 {
+			bulk := n >= config.BufferSize
+			compress := s.Compressed() && compression.Worth((*buf)[:n])
+			if werr := send(s, conn, *buf, n, bulk && coalesce, compress, before); werr != nil {
+				return werr
+			}
+			// switch buffers when the kind of traffic changes
+			if large := len(*buf) == config.MaxMessageSize; bulk != large {
+				putBuffer(buf)
+				buf = getBuffer(bulk)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// send writes a message starting with the first n bytes of buf. For bulk
+// transfers the message is filled with what conn delivers in the meantime.
+func send(s transport.Stream, conn net.Conn, buf []byte, n int, bulk, compress bool, before func(n int) error) error {
+	if before != nil {
+		if err := before(n); err != nil {
+			return err
+		}
+	}
+
+	w, err := s.NextWriter(compress)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	if !bulk {
+		return w.Close()
+	}
+
+	defer conn.SetReadDeadline(time.Time{})
+	for size := n; size < config.MaxMessageSize; size += n {
+		conn.SetReadDeadline(time.Now().Add(config.CoalesceWait))
+		n, err = conn.Read(buf[:min(len(buf), config.MaxMessageSize-size)])
+		if n > 0 {
+			if before != nil {
+				if err := before(n); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			// the data read so far is sent before failing
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Receive copies the messages of s to w until reading or writing fails.
+// after, when set, is called with the size of every message written.
+func Receive(s transport.Stream, w io.Writer, after func(n int64)) error {
+	for {
+		r, err := s.NextReader()
+		if err != nil {
+			return err
+		}
+
+		buf := getBuffer(true)
+		// hide ReadFrom of TCP connections, which allocates a buffer of its own
+		n, err := io.CopyBuffer(writerOnly{w}, r, *buf)
+		putBuffer(buf)
+		if after != nil {
+			after(n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writerOnly hides any other method of an io.Writer.
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,267 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/transport"
+	"github.com/gorilla/websocket"
+)
+
+// tunnel sets up a tunnel between the agent and the server ends of a session
+// over loopback, it returns a function tearing the tunnel down.
+type tunnel func(agentConn, serverConn net.Conn) (func(), error)
+
+// tunnels are the copy loops compared, legacy is the one used before this
+// package.
+var tunnels = []struct {
+	name string
+	t    tunnel
+}{
+	{"legacy", legacyTunnel},
+	{"websocket", webSocketTunnel},
+	{"mux", muxTunnel},
+}
+
+// BenchmarkRelayBulk transfers 32KiB writes from the client to the
+// destination.
+func BenchmarkRelayBulk(b *testing.B) {
+	for _, tt := range tunnels {
+		b.Run(tt.name, func(b *testing.B) {
+			client, dest := newTunnel(b, tt.t)
+			buf := make([]byte, config.MaxMessageSize)
+
+			b.SetBytes(int64(len(buf)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := io.CopyN(io.Discard, dest, int64(b.N)*int64(len(buf)))
+				errCh <- err
+			}()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := <-errCh; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// BenchmarkRelayInteractive round trips small writes echoed by the
+// destination.
+func BenchmarkRelayInteractive(b *testing.B) {
+	for _, tt := range tunnels {
+		b.Run(tt.name, func(b *testing.B) {
+			client, dest := newTunnel(b, tt.t)
+			go io.Copy(dest, dest)
+			msg := make([]byte, 64)
+
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(msg); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(client, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// newTunnel returns the client and destination ends of a tunnel set up by t,
+// which is torn down once b is done.
+func newTunnel(b *testing.B, t tunnel) (net.Conn, net.Conn) {
+	b.Helper()
+
+	client, agentConn := tcpPair(b)
+	serverConn, dest := tcpPair(b)
+	closeTunnel, err := t(agentConn, serverConn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(closeTunnel)
+	return client, dest
+}
+
+// tcpPair returns both ends of a loopback TCP connection, closed once b is
+// done.
+func tcpPair(b *testing.B) (net.Conn, net.Conn) {
+	b.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		c.Close()
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c, s
+}
+
+// legacyTunnel copies the data of a session the way it was before this
+// package, a message per read over a websocket with the default buffers.
+func legacyTunnel(agentConn, serverConn net.Conn) (func(), error) {
+	upgrader := websocket.Upgrader{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		go legacyReceive(ws, serverConn)
+		go legacySend(ws, serverConn)
+	})}
+	go srv.Serve(l)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+l.Addr().String()+"/session", nil)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	go legacySend(ws, agentConn)
+	go legacyReceive(ws, agentConn)
+
+	return func() {
+		ws.Close()
+		srv.Close()
+	}, nil
+}
+
+func legacySend(ws *websocket.Conn, conn net.Conn) error {
+	buf := make([]byte, config.BufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+func legacyReceive(ws *websocket.Conn, conn net.Conn) error {
+	buf := make([]byte, config.BufferSize)
+	for {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyBuffer(conn, r, buf); err != nil {
+			return err
+		}
+	}
+}
+
+// webSocketTunnel relays the data of a session over the websocket transport.
+func webSocketTunnel(agentConn, serverConn net.Conn) (func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(transport.WebSocketRequest(w, r, "", r.URL.Path), serverConn)
+	})}
+	go srv.Serve(l)
+
+	closeStream, err := open(&transport.WebSocket{Address: l.Addr().String()}, agentConn)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return func() {
+		closeStream()
+		srv.Close()
+	}, nil
+}
+
+// muxTunnel relays the data of a session over the mux transport.
+func muxTunnel(agentConn, serverConn net.Conn) (func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go transport.ServeMux(l, func(req *transport.Request) {
+		serve(req, serverConn)
+	})
+
+	closeStream, err := open(&transport.Mux{Address: l.Addr().String()}, agentConn)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return func() {
+		closeStream()
+		l.Close()
+	}, nil
+}
+
+// serve accepts the requests of the agent end, relaying its session to
+// serverConn.
+func serve(req *transport.Request, serverConn net.Conn) {
+	if req.Route == "/register" {
+		conn, err := req.AcceptConn()
+		if err != nil {
+			return
+		}
+		for _, err := conn.ReadMessage(); err == nil; _, err = conn.ReadMessage() {
+		}
+		return
+	}
+
+	stream, err := req.AcceptStream("bench", false)
+	if err != nil {
+		return
+	}
+	go Receive(stream, serverConn, nil)
+	go Send(stream, serverConn, nil)
+}
+
+// open registers with t and relays a session to agentConn, it returns a
+// function closing both.
+func open(t transport.Transport, agentConn net.Conn) (func(), error) {
+	ctrl, err := t.Dial(context.Background(), http.Header{})
+	if err != nil {
+		return nil, err
+	}
+	stream, err := ctrl.Open(context.Background(), http.Header{})
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	go Send(stream, agentConn, nil)
+	go Receive(stream, agentConn, nil)
+
+	return func() {
+		stream.Close()
+		ctrl.Close()
+	}, nil
+}
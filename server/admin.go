@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+
+	"github.com/easzlab/ezvpn/handoff"
+	"github.com/easzlab/ezvpn/logging"
+)
+
+// StartAdmin starts the admin server on addr, an error is returned when it
+// can not listen. It serves the metrics at /debug/vars and the admin views
+// under /admin/, and must not be exposed to agents.
+func StartAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/admin/blocked", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, locks.blocked())
+	})
+	mux.HandleFunc("/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		if usageStore == nil {
+			writeJSON(w, []any{})
+			return
+		}
+		writeJSON(w, usageStore.List())
+	})
+
+	mux.Handle("/admin/loglevel", logging.Handler())
+
+	l, err := handoff.Listen("admin", addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("ezvpn admin server is running", "address", addr)
+	go http.Serve(l, mux)
+	return nil
+}
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
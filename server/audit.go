@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"time"
+
+	"github.com/easzlab/ezvpn/audit"
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/socks"
+)
+
+// auditLog records every tunneled connection, it is nil unless enabled.
+var auditLog *audit.Logger
+
+// initAudit opens the audit log when it is enabled.
+func initAudit() {
+	if config.SERVER.AuditLog == "" {
+		return
+	}
+
+	maxSize, err := config.ParseSize(config.SERVER.AuditLogMaxSize)
+	if err != nil {
+		logger.Error("invalid audit log max size", "error", err)
+		os.Exit(1)
+	}
+	auditLog, err = audit.Open(config.SERVER.AuditLog, maxSize, config.SERVER.AuditLogBackups)
+	if err != nil {
+		logger.Error("failed to open the audit log", "error", err)
+		os.Exit(1)
+	}
+}
+
+// newRecord starts the audit record of a session of agent from source.
+func newRecord(agent config.Agent, state *tls.ConnectionState, source string) *audit.Record {
+	rec := &audit.Record{SessionID: newID(), Agent: agent.Name, Source: source, Start: time.Now()}
+	if state != nil && len(state.PeerCertificates) > 0 {
+		rec.CN = state.PeerCertificates[0].Subject.CommonName
+	}
+	return rec
+}
+
+// writeRecord completes rec with the socks request served, nil when the
+// handshake failed, and writes it to the audit log.
+func writeRecord(rec *audit.Record, req *socks.Request) {
+	if auditLog == nil {
+		return
+	}
+
+	rec.Duration = time.Since(rec.Start).Milliseconds()
+	rec.Result = "handshake failed"
+	if req != nil {
+		rec.Code = req.Reply
+		rec.Result = socks.ReplyText(req.Reply)
+		if dest := req.DestAddr; dest != nil {
+			rec.DestFQDN, rec.DestPort = dest.FQDN, dest.Port
+			if len(dest.IP) > 0 {
+				rec.DestIP = dest.IP.String()
+			}
+		}
+	}
+	if err := auditLog.Write(*rec); err != nil {
+		logger.Error("failed to write audit record", "session_id", rec.SessionID, "error", err)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/socks"
+	"github.com/easzlab/ezvpn/transport"
+)
+
+// portStream is a stream whose messages are only compressed once the
+// destination port of its session is known to be one of ports.
+type portStream struct {
+	transport.Stream
+	ports   []config.PortRange
+	allowed atomic.Bool
+}
+
+func (s *portStream) Compressed() bool {
+	return s.allowed.Load() && s.Stream.Compressed()
+}
+
+// rule returns rule, which is nil to allow any destination, learning the
+// destination port from the requests it checks.
+func (s *portStream) rule(rule socks.Rule) socks.Rule {
+	return func(req *socks.Request) bool {
+		for _, r := range s.ports {
+			if r.Contains(req.DestAddr.Port) {
+				s.allowed.Store(true)
+				break
+			}
+		}
+		return rule == nil || rule(req)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/easzlab/ezvpn/auth"
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/control"
+	"github.com/easzlab/ezvpn/handoff"
+	"github.com/easzlab/ezvpn/pki"
+	"github.com/labstack/echo/v4"
+)
+
+// enrollMu serializes enrollments, so that a token is only used once between
+// being checked and redeemed.
+var enrollMu sync.Mutex
+
+// startEnroll listens on addr and serves the `/enroll` endpoint in the
+// background, without TLS when tlsConfig is nil. Enrolling agents have no
+// client certificate yet, so it has a listener of its own and the control
+// port keeps requiring one.
+func startEnroll(addr string, tlsConfig *tls.Config) {
+	// the listener is inherited from the previous process on upgrade
+	l, err := handoff.Listen("enroll", addr)
+	if err != nil {
+		logger.Error("failed to listen", "address", addr, "error", err)
+		os.Exit(1)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	e := newEcho()
+	e.POST("/enroll", PostEnroll)
+
+	logger.Info("enrollment is running", "address", l.Addr().String())
+	go func() {
+		err := http.Serve(l, e)
+		// the listener is closed first on shutdown
+		if !draining.Load() && !errors.Is(err, net.ErrClosed) {
+			logger.Error("enrollment failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// PostEnroll enrolls a new agent: the CSR is signed by the built-in CA, the
+// agent gets a new auth key and the bootstrap token is redeemed, in this
+// order so that the token is not lost when enrolling fails. The agent name
+// comes from the token, the subject of the CSR is ignored.
+func PostEnroll(c echo.Context) error {
+	var req control.EnrollRequest
+	if err := c.Bind(&req); err != nil {
+		return Error(c, http.StatusBadRequest, err)
+	}
+	// enrolling agents have no identity yet, only their IP is locked out
+	if wait := locks.locked(c.RealIP(), ""); wait > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		err := fmt.Errorf("too many failed auths, retry in %s", wait.Round(time.Second))
+		return Error(c, http.StatusTooManyRequests, err)
+	}
+
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return Error(c, http.StatusBadRequest, fmt.Errorf("failed to enroll: no CSR"))
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return Error(c, http.StatusBadRequest, fmt.Errorf("failed to enroll: %s", err))
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return Error(c, http.StatusBadRequest, fmt.Errorf("failed to enroll: %s", err))
+	}
+
+	enrollMu.Lock()
+	defer enrollMu.Unlock()
+
+	token, err := auth.FindBootstrapToken(config.SERVER.EnrollTokens, req.Token)
+	if err != nil {
+		locks.fail(c.RealIP(), "")
+		return Error(c, http.StatusUnauthorized, fmt.Errorf("failed to enroll: %s", err))
+	}
+	name := token.Name
+
+	der, err := pki.SignAgent(config.SERVER.CADir, name, csr.PublicKey, config.AgentCertValidity)
+	if err != nil {
+		return Error(c, http.StatusInternalServerError, err)
+	}
+	ca, err := os.ReadFile(filepath.Join(config.SERVER.CADir, pki.CAFile))
+	if err != nil {
+		return Error(c, http.StatusInternalServerError, err)
+	}
+
+	key, err := config.EnrollAgent(config.SERVER.ConfigFile, name, name, token.Replace)
+	if errors.Is(err, config.ErrAgentExists) {
+		return Error(c, http.StatusConflict, fmt.Errorf("failed to enroll: %s, the token does not allow to replace it", err))
+	}
+	if err != nil {
+		return Error(c, http.StatusInternalServerError, err)
+	}
+
+	if _, err := auth.RedeemBootstrapToken(config.SERVER.EnrollTokens, req.Token); err != nil {
+		return Error(c, http.StatusInternalServerError, err)
+	}
+
+	logger.Info("agent enrolled", "agent", name, "remote", c.RealIP())
+	return c.JSON(http.StatusOK, control.EnrollResponse{
+		Name:        name,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		CA:          string(ca),
+		AuthKey:     key,
+	})
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/easzlab/ezvpn/auth"
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/control"
+	"github.com/easzlab/ezvpn/pki"
+)
+
+// setupEnroll points the server config at a new CA, allowed agents file
+// holding test-001 and token file, restored at the end of the test.
+func setupEnroll(t *testing.T) {
+	t.Helper()
+	saved, savedLocks := config.SERVER, locks.ips
+	t.Cleanup(func() {
+		config.SERVER = saved
+		locks.mu.Lock()
+		locks.ips = savedLocks
+		locks.mu.Unlock()
+	})
+	// failed enrolls of a test are not to lock out the next ones
+	locks.mu.Lock()
+	locks.ips = map[string]*failures{}
+	locks.mu.Unlock()
+
+	dir := t.TempDir()
+	if err := pki.InitCA(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	agents := filepath.Join(dir, "allowed-agents.yml")
+	if err := os.WriteFile(agents, []byte("agents:\n  - name: test-001\n    auth_key: key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.SERVER.CADir = dir
+	config.SERVER.ConfigFile = agents
+	config.SERVER.EnrollTokens = filepath.Join(dir, "enroll-tokens.json")
+}
+
+// enroll posts an enrollment with token and a new CSR, and returns the
+// response status and body.
+func enroll(t *testing.T, token string) (int, control.EnrollResponse) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(control.EnrollRequest{
+		Token: token,
+		CSR:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newEcho()
+	e.POST("/enroll", PostEnroll)
+	req := httptest.NewRequest(http.MethodPost, "/enroll", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	var resp control.EnrollResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestEnroll(t *testing.T) {
+	setupEnroll(t)
+
+	token, err := auth.CreateBootstrapToken(config.SERVER.EnrollTokens, "laptop-01", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, resp := enroll(t, token)
+	if status != http.StatusOK {
+		t.Fatalf("enroll = %d, want %d", status, http.StatusOK)
+	}
+	if resp.Name != "laptop-01" || resp.AuthKey == "" || resp.CA == "" {
+		t.Fatalf("enroll = %+v, want laptop-01 with an auth key and the CA", resp)
+	}
+	block, _ := pem.Decode([]byte(resp.Certificate))
+	if block == nil {
+		t.Fatal("no certificate enrolled")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "laptop-01" {
+		t.Errorf("certificate CN = %q, want laptop-01", cert.Subject.CommonName)
+	}
+
+	data, err := os.ReadFile(config.SERVER.ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "name: laptop-01") || strings.Contains(string(data), resp.AuthKey) {
+		t.Errorf("allowed agents = %s, want laptop-01 with the hash of its key", data)
+	}
+
+	// the token is redeemed
+	if status, _ := enroll(t, token); status != http.StatusUnauthorized {
+		t.Errorf("enroll with a redeemed token = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestEnrollRefused(t *testing.T) {
+	setupEnroll(t)
+	file := config.SERVER.EnrollTokens
+
+	expired, err := auth.CreateBootstrapToken(file, "laptop-01", -time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := auth.CreateBootstrapToken(file, "test-001", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replace, err := auth.CreateBootstrapToken(file, "test-001", time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"expired token", expired, http.StatusUnauthorized},
+		{"unknown token", "unknown", http.StatusUnauthorized},
+		{"existing agent", existing, http.StatusConflict},
+		// the refused token is not redeemed
+		{"existing agent again", existing, http.StatusConflict},
+		{"replaced agent", replace, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		if status, _ := enroll(t, tt.token); status != tt.want {
+			t.Errorf("%s: enroll = %d, want %d", tt.name, status, tt.want)
+		}
+	}
+
+	data, err := os.ReadFile(config.SERVER.ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "auth_key: key") {
+		t.Errorf("auth key of the replaced agent kept: %s", data)
+	}
+}
+
+func TestEnrollConcurrently(t *testing.T) {
+	setupEnroll(t)
+
+	const n = 8
+	tokens := make([]string, n)
+	for i := range tokens {
+		var err error
+		tokens[i], err = auth.CreateBootstrapToken(config.SERVER.EnrollTokens, fmt.Sprintf("laptop-%02d", i), time.Hour, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every token is used twice at once, each must enroll exactly once
+	var wg sync.WaitGroup
+	statuses := make([]int, 2*n)
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], _ = enroll(t, tokens[i%n])
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		ok := 0
+		for _, status := range []int{statuses[i], statuses[i+n]} {
+			if status == http.StatusOK {
+				ok++
+			}
+		}
+		if ok != 1 {
+			t.Errorf("token of laptop-%02d enrolled %d times, want once", i, ok)
+		}
+	}
+
+	data, err := os.ReadFile(config.SERVER.ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if name := fmt.Sprintf("name: laptop-%02d", i); strings.Count(string(data), name) != 1 {
+			t.Errorf("allowed agents hold %d entries of laptop-%02d, want 1", strings.Count(string(data), name), i)
+		}
+	}
+	info, err := os.Stat(config.SERVER.ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("allowed agents mode = %o, want 600", perm)
+	}
+}
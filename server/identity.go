@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/easzlab/ezvpn/config"
+)
+
+// What a `*` in an approved identity matches: exactly one DNS label, one path
+// segment of a URI, or one label of a DN attribute value.
+const (
+	labelWildcard   = `[^.]+`
+	segmentWildcard = `[^/]+`
+	dnWildcard      = `[^.,]+`
+)
+
+// pattern is a wildcard pattern along with what its `*` matches.
+type pattern struct {
+	expr     string
+	wildcard string
+}
+
+// patterns holds the compiled patterns of the allowed agents, compiled again
+// whenever they are reloaded.
+var patterns atomic.Pointer[map[pattern]*regexp.Regexp]
+
+// compilePatterns compiles the wildcard patterns of the allowed agents.
+func compilePatterns() {
+	compiled := map[pattern]*regexp.Regexp{}
+	add := func(exprs []string, wildcard string) {
+		for _, expr := range exprs {
+			if strings.Contains(expr, "*") {
+				p := pattern{expr, wildcard}
+				compiled[p] = p.compile()
+			}
+		}
+	}
+	for _, agent := range config.AGENTS.Agents {
+		add(agent.ApprovedCNs, labelWildcard)
+		add(agent.ApprovedSANs, labelWildcard)
+		add(agent.ApprovedURIs, segmentWildcard)
+		add(agent.ApprovedIssuers, labelWildcard)
+		add(agent.ApprovedIssuers, dnWildcard)
+	}
+	patterns.Store(&compiled)
+}
+
+// compile returns the case-insensitive regexp matching p as a whole.
+func (p pattern) compile() *regexp.Regexp {
+	expr := strings.ReplaceAll(regexp.QuoteMeta(p.expr), `\*`, p.wildcard)
+	return regexp.MustCompile("(?i)^" + expr + "$")
+}
+
+// compiled returns the regexp of p, precompiled by compilePatterns unless p
+// is not an approved identity of the allowed agents, such as a CN of a JWT.
+func (p pattern) compiled() *regexp.Regexp {
+	if all := patterns.Load(); all != nil {
+		if re, ok := (*all)[p]; ok {
+			return re
+		}
+	}
+	return p.compile()
+}
+
+// verifyIdentity checks the agent's client certificate against the identity
+// approved for agent. The leaf certificate must match one of the approved
+// CNs, SANs or URI SANs; when approved issuers are set, one of the CAs of the
+// chain must match too, and when a fingerprint is pinned, the leaf must have
+// that SHA-256 fingerprint. Every verified chain is tried.
+func verifyIdentity(state *tls.ConnectionState, agent config.Agent) bool {
+	if state == nil {
+		return false
+	}
+
+	for _, chain := range state.VerifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		leaf := chain[0]
+
+		if !matchSubject(leaf, agent) {
+			continue
+		}
+		if len(agent.ApprovedIssuers) > 0 && !matchIssuer(chain[1:], agent.ApprovedIssuers) {
+			continue
+		}
+		if agent.Fingerprint != "" && !matchFingerprint(leaf, agent.Fingerprint) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// matchSubject reports whether the CN, a DNS/email/IP SAN or a URI SAN of
+// cert is approved for agent.
+func matchSubject(cert *x509.Certificate, agent config.Agent) bool {
+	if matchAny(agent.ApprovedCNs, cert.Subject.CommonName, labelWildcard) {
+		return true
+	}
+
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, san := range sans {
+		if matchAny(agent.ApprovedSANs, san, labelWildcard) {
+			return true
+		}
+	}
+
+	for _, uri := range cert.URIs {
+		if matchAny(agent.ApprovedURIs, uri.String(), segmentWildcard) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchIssuer reports whether one of the CAs is an approved issuer, matched
+// on either its CN or its full subject DN.
+func matchIssuer(cas []*x509.Certificate, approved []string) bool {
+	for _, ca := range cas {
+		if matchAny(approved, ca.Subject.CommonName, labelWildcard) || matchAny(approved, ca.Subject.String(), dnWildcard) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFingerprint reports whether cert has the given SHA-256 fingerprint,
+// written in hex with or without colons.
+func matchFingerprint(cert *x509.Certificate, fingerprint string) bool {
+	sum := sha256.Sum256(cert.Raw)
+	want := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	return hex.EncodeToString(sum[:]) == want
+}
+
+// matchAny reports whether value matches one of the patterns, matching is
+// case-insensitive. A `*` in a pattern matches what wildcard tells, never an
+// empty string.
+func matchAny(exprs []string, value, wildcard string) bool {
+	for _, expr := range exprs {
+		if !strings.Contains(expr, "*") {
+			if strings.EqualFold(expr, value) {
+				return true
+			}
+			continue
+		}
+
+		if (pattern{expr, wildcard}).compiled().MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
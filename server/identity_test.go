@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/transport"
+)
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		value    string
+		wildcard string
+		want     bool
+	}{
+		{"laptop-01", "laptop-01", labelWildcard, true},
+		{"laptop-01", "LAPTOP-01", labelWildcard, true},
+		{"laptop-01", "laptop-011", labelWildcard, false},
+		{"laptop-*", "laptop-01", labelWildcard, true},
+		{"laptop-*", "laptop-", labelWildcard, false},
+		{"laptop-*", "laptop-01.corp.example", labelWildcard, false},
+		{"*.corp.example", "a.corp.example", labelWildcard, true},
+		{"*.corp.example", "A.Corp.Example", labelWildcard, true},
+		{"*.corp.example", "a.b.corp.example", labelWildcard, false},
+		{"*.corp.example", ".corp.example", labelWildcard, false},
+		{"*.corp.example", "corp.example", labelWildcard, false},
+		{"*.corp.example", "a.corp.example.evil", labelWildcard, false},
+		{"a.*.example", "a.b.example", labelWildcard, true},
+		{"a.*.example", "a.b.c.example", labelWildcard, false},
+		{"laptop.?", "laptop.x", labelWildcard, false},
+		{"spiffe://corp/agent/*", "spiffe://corp/agent/laptop-01", segmentWildcard, true},
+		{"spiffe://corp/agent/*", "spiffe://corp/agent/laptop.01", segmentWildcard, true},
+		{"spiffe://corp/agent/*", "spiffe://corp/agent/a/b", segmentWildcard, false},
+		{"spiffe://corp/agent/*", "spiffe://corp/agent/", segmentWildcard, false},
+		{"spiffe://corp/*/laptop", "spiffe://corp/agent/laptop", segmentWildcard, true},
+		{"CN=*,OU=EZVPN", "CN=ezvpn-ca,OU=EZVPN", dnWildcard, true},
+		{"CN=*,OU=EZVPN", "CN=ezvpn-ca,O=x,OU=EZVPN", dnWildcard, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchAny([]string{tt.pattern}, tt.value, tt.wildcard); got != tt.want {
+			t.Errorf("matchAny(%q, %q) = %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCompilePatterns(t *testing.T) {
+	saved := config.AGENTS
+	defer func() {
+		config.AGENTS = saved
+		compilePatterns()
+	}()
+
+	config.AGENTS = config.AllowedAgents{Agents: []config.Agent{{
+		Name:         "laptops",
+		ApprovedCNs:  []string{"laptop-*"},
+		ApprovedURIs: []string{"spiffe://corp/agent/*"},
+	}}}
+	compilePatterns()
+
+	all := *patterns.Load()
+	for _, p := range []pattern{{"laptop-*", labelWildcard}, {"spiffe://corp/agent/*", segmentWildcard}} {
+		if _, ok := all[p]; !ok {
+			t.Errorf("pattern %q is not precompiled", p.expr)
+		}
+	}
+	if len(all) != 2 {
+		t.Errorf("%d patterns precompiled, want 2", len(all))
+	}
+}
+
+func TestMatchSubject(t *testing.T) {
+	agent := config.Agent{
+		Name:         "laptops",
+		ApprovedCNs:  []string{"laptop-*"},
+		ApprovedSANs: []string{"*.corp.example"},
+		ApprovedURIs: []string{"spiffe://corp/agent/*"},
+	}
+	uri, _ := url.Parse("spiffe://corp/agent/laptop-01")
+	deep, _ := url.Parse("spiffe://corp/agent/laptop-01/extra")
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{"cn", &x509.Certificate{Subject: pkix.Name{CommonName: "laptop-01"}}, true},
+		{"cn with a dot", &x509.Certificate{Subject: pkix.Name{CommonName: "laptop-01.evil"}}, false},
+		{"dns san", &x509.Certificate{DNSNames: []string{"a.corp.example"}}, true},
+		{"nested dns san", &x509.Certificate{DNSNames: []string{"a.b.corp.example"}}, false},
+		{"uri san", &x509.Certificate{URIs: []*url.URL{uri}}, true},
+		{"nested uri san", &x509.Certificate{URIs: []*url.URL{deep}}, false},
+		{"none", &x509.Certificate{Subject: pkix.Name{CommonName: "server"}}, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchSubject(tt.cert, agent); got != tt.want {
+			t.Errorf("%s: matchSubject = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// certRequest returns a request with a verified certificate for cn.
+func certRequest(cn string) *transport.Request {
+	chains := [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}
+	return &transport.Request{TLS: &tls.ConnectionState{VerifiedChains: chains}}
+}
+
+func TestIdentityNarrowedOnReload(t *testing.T) {
+	saved := config.AGENTS
+	defer func() {
+		config.AGENTS = saved
+		compilePatterns()
+	}()
+
+	agent := config.Agent{Name: "laptops", AuthKey: "sha256:00", ApprovedCNs: []string{"laptop-*"}}
+	config.AGENTS = config.AllowedAgents{Agents: []config.Agent{agent}}
+	compilePatterns()
+
+	kept, narrowed := &fakeConn{}, &fakeConn{}
+	ch := agents.register(agent, certRequest("laptop-01"), kept)
+	defer agents.unregister(ch)
+	other := agents.register(agent, certRequest("laptop-02"), narrowed)
+	defer agents.unregister(other)
+
+	// the approved CNs are narrowed by a reload, the auth key is unchanged
+	agent.ApprovedCNs = []string{"laptop-01"}
+	config.AGENTS = config.AllowedAgents{Agents: []config.Agent{agent}}
+	compilePatterns()
+	agents.revokeRemoved()
+
+	if reason := narrowed.closedFor(); reason != "revoked" {
+		t.Fatalf("control channel of laptop-02 closed for %q, want revoked", reason)
+	}
+	if reason := kept.closedFor(); reason != "" {
+		t.Fatalf("control channel of laptop-01 closed for %q", reason)
+	}
+	if _, ok := agents.channel(ch.id); !ok {
+		t.Fatal("control channel of laptop-01 unregistered")
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"expvar"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/easzlab/ezvpn/auth"
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/transport"
+)
+
+// metrics of failed auths, exported with expvar.
+var (
+	authFailures = expvar.NewInt("auth_failures_total")
+	authLockouts = expvar.NewInt("auth_lockouts_total")
+)
+
+// failures records the failed auths of a source IP or a targeted identity.
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// lockout throttles failed auths per source IP and per targeted identity,
+// with a lockout growing exponentially once config.AuthFailureThreshold is
+// exceeded.
+type lockout struct {
+	mu      sync.Mutex
+	ips     map[string]*failures
+	targets map[string]*failures
+}
+
+var locks = lockout{ips: map[string]*failures{}, targets: map[string]*failures{}}
+
+func init() {
+	expvar.Publish("auth_blocked_ips", expvar.Func(func() any {
+		return len(locks.blocked())
+	}))
+}
+
+// authTarget returns the credential req tries to authenticate with, as the
+// server resolves it before verifying the key: the allowed agent the key is
+// verified against, or for a JWT the verified certificate along with the JWT
+// key named by the token. It is empty when no key is verified, e.g. without a
+// verified certificate or with a ticket. Unlike the presented credential or
+// the agent name sent along, it can not be varied at will, and only the
+// holders of a certificate matching an agent can get it locked out.
+func authTarget(req *transport.Request, scheme, key string) string {
+	if scheme != "Bearer" || key == "" {
+		return ""
+	}
+	if auth.IsToken(key) && len(config.AGENTS.JWTKeys) > 0 {
+		state := req.TLS
+		if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+			return ""
+		}
+		return "cn:" + state.VerifiedChains[0][0].Subject.CommonName + "/jwt:" + tokenKeyID(key)
+	}
+	if candidates := candidateAgents(req); len(candidates) == 1 {
+		return "agent:" + candidates[0].Name
+	}
+	return ""
+}
+
+// locked returns how long ip, or target, is still locked out.
+func (l *lockout) locked(ip, target string) time.Duration {
+	if allowlisted(ip) {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(0)
+	if f, ok := l.ips[ip]; ok && f.until.After(now) {
+		wait = f.until.Sub(now)
+	}
+	if target != "" {
+		if f, ok := l.targets[target]; ok && f.until.After(now) && f.until.Sub(now) > wait {
+			wait = f.until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// fail records a failed auth from ip targeting the identity target.
+func (l *lockout) fail(ip, target string) {
+	authFailures.Add(1)
+	if allowlisted(ip) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.record(l.ips, ip)
+	if target != "" {
+		l.record(l.targets, target)
+	}
+}
+
+// succeed clears the failed auths of ip and of target.
+func (l *lockout) succeed(ip, target string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.ips, ip)
+	delete(l.targets, target)
+}
+
+// record counts a failure in m, and locks its source out past the threshold.
+func (l *lockout) record(m map[string]*failures, id string) {
+	f, ok := m[id]
+	if !ok {
+		f = &failures{}
+		m[id] = f
+	}
+
+	now := time.Now()
+	f.count++
+	f.last = now
+	if f.count < config.AuthFailureThreshold {
+		return
+	}
+
+	wait := config.AuthLockoutMax
+	if n := f.count - config.AuthFailureThreshold; n < 32 {
+		if d := config.AuthLockoutBase << n; d < wait {
+			wait = d
+		}
+	}
+	f.until = now.Add(wait)
+	authLockouts.Add(1)
+}
+
+// pruneEvery runs expire every interval, so that the failures are forgotten
+// even when no auth fails anymore.
+func (l *lockout) pruneEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mu.Lock()
+		l.expire()
+		l.mu.Unlock()
+	}
+}
+
+// expire forgets the failures older than config.AuthFailureWindow which are
+// no longer locked out. The caller must hold l.mu.
+func (l *lockout) expire() {
+	now := time.Now()
+	for _, m := range []map[string]*failures{l.ips, l.targets} {
+		for id, f := range m {
+			if now.Sub(f.last) > config.AuthFailureWindow && now.After(f.until) {
+				delete(m, id)
+			}
+		}
+	}
+}
+
+// blockedIP is an IP currently locked out.
+type blockedIP struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// blocked returns the IPs currently locked out.
+func (l *lockout) blocked() []blockedIP {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	list := []blockedIP{}
+	for ip, f := range l.ips {
+		if f.until.After(now) {
+			list = append(list, blockedIP{IP: ip, Failures: f.count, Until: f.until})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.After(list[j].Until) })
+	return list
+}
+
+// allowlisted reports whether ip is in the auth allowlist, which is never
+// locked out.
+func allowlisted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range config.SERVER.AuthAllowlist {
+		if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(parsed) {
+			return true
+		}
+		if allowed := net.ParseIP(cidr); allowed != nil && allowed.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easzlab/ezvpn/auth"
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/control"
+	"github.com/easzlab/ezvpn/transport"
+)
+
+func newLockout() *lockout {
+	return &lockout{ips: map[string]*failures{}, targets: map[string]*failures{}}
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	l := newLockout()
+	ip := "192.0.2.1"
+
+	for i := 1; i < config.AuthFailureThreshold; i++ {
+		l.fail(ip, "")
+		if wait := l.locked(ip, ""); wait != 0 {
+			t.Fatalf("locked out for %s after %d failures", wait, i)
+		}
+	}
+
+	// the lockout doubles with every failure past the threshold
+	want := config.AuthLockoutBase
+	for i := 0; i < 4; i++ {
+		l.fail(ip, "")
+		wait := l.locked(ip, "")
+		if wait <= want/2 || wait > want {
+			t.Fatalf("locked out for %s after %d failures, want %s", wait, config.AuthFailureThreshold+i, want)
+		}
+		want *= 2
+	}
+
+	// and is capped
+	l.ips[ip].count = config.AuthFailureThreshold + 64
+	l.fail(ip, "")
+	if wait := l.locked(ip, ""); wait <= config.AuthLockoutMax-time.Minute || wait > config.AuthLockoutMax {
+		t.Fatalf("locked out for %s, want %s", wait, config.AuthLockoutMax)
+	}
+
+	l.succeed(ip, "")
+	if wait := l.locked(ip, ""); wait != 0 {
+		t.Fatalf("locked out for %s after a successful auth", wait)
+	}
+}
+
+func TestLockoutTarget(t *testing.T) {
+	l := newLockout()
+	target := "agent:laptop-01"
+
+	// failures from several IPs add up against the target
+	for i := 0; i < config.AuthFailureThreshold; i++ {
+		l.fail(fmt.Sprintf("192.0.2.%d", i+1), target)
+	}
+	if wait := l.locked("198.51.100.1", target); wait == 0 {
+		t.Fatal("target not locked out from another IP")
+	}
+	if wait := l.locked("198.51.100.1", "agent:laptop-02"); wait != 0 {
+		t.Fatalf("other target locked out for %s", wait)
+	}
+	if wait := l.locked("192.0.2.1", ""); wait != 0 {
+		t.Fatalf("IP locked out for %s after a single failure", wait)
+	}
+}
+
+func TestLockoutAllowlist(t *testing.T) {
+	saved := config.SERVER
+	defer func() { config.SERVER = saved }()
+	config.SERVER.AuthAllowlist = []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"192.0.2.7", true},
+		{"2001:db8::1", true},
+		{"192.0.2.8", false},
+		{"11.0.0.1", false},
+		{"not-an-ip", false},
+	}
+
+	for _, tt := range tests {
+		if got := allowlisted(tt.ip); got != tt.want {
+			t.Errorf("allowlisted(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+
+		l := newLockout()
+		for i := 0; i < 2*config.AuthFailureThreshold; i++ {
+			l.fail(tt.ip, "")
+		}
+		if locked := l.locked(tt.ip, "") > 0; locked == tt.want {
+			t.Errorf("%s: locked out = %v, want %v", tt.ip, locked, !tt.want)
+		}
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	saved := config.SERVER
+	defer func() { config.SERVER = saved }()
+
+	tests := []struct {
+		proxies []string
+		remote  string
+		xff     string
+		want    string
+	}{
+		{nil, "192.0.2.1:1234", "", "192.0.2.1"},
+		{nil, "192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{[]string{"192.0.2.1"}, "192.0.2.1:1234", "198.51.100.1", "198.51.100.1"},
+		{[]string{"192.0.2.0/24"}, "192.0.2.9:1234", "198.51.100.1", "198.51.100.1"},
+		// the header is only trusted from the proxies
+		{[]string{"192.0.2.1"}, "192.0.2.2:1234", "198.51.100.1", "192.0.2.2"},
+		// private and loopback addresses are not trusted by default
+		{[]string{"192.0.2.1"}, "127.0.0.1:1234", "198.51.100.1", "127.0.0.1"},
+		{[]string{"192.0.2.1"}, "10.0.0.1:1234", "198.51.100.1", "10.0.0.1"},
+		// addresses appended by untrusted hops are not taken
+		{[]string{"192.0.2.1"}, "192.0.2.1:1234", "203.0.113.1, 198.51.100.1", "198.51.100.1"},
+		{[]string{"2001:db8::1"}, "[2001:db8::1]:1234", "198.51.100.1", "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		config.SERVER.TrustedProxies = tt.proxies
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := ipExtractor()(req); got != tt.want {
+			t.Errorf("proxies %v, remote %s, X-Forwarded-For %q: real IP = %s, want %s", tt.proxies, tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestAuthTarget(t *testing.T) {
+	saved := config.AGENTS
+	defer func() {
+		config.AGENTS = saved
+		compilePatterns()
+	}()
+	config.AGENTS = config.AllowedAgents{
+		Agents: []config.Agent{
+			{Name: "laptops", ApprovedCNs: []string{"laptop-*"}},
+			{Name: "laptop-01", ApprovedCNs: []string{"laptop-01"}},
+			{Name: "servers", ApprovedCNs: []string{"server-*"}},
+		},
+		JWTKeys: []config.JWTKey{{ID: "main", Algorithm: "HS256", Key: []byte(strings.Repeat("s", config.JWTSecretMinSize))}},
+	}
+	compilePatterns()
+
+	request := func(cn, name string) *transport.Request {
+		req := &transport.Request{Header: http.Header{}}
+		if cn != "" {
+			req.TLS = certRequest(cn).TLS
+		}
+		if name != "" {
+			req.Header.Set(control.HeaderAgentName, name)
+		}
+		return req
+	}
+	secret := strings.Repeat("s", config.JWTSecretMinSize)
+	withKid := signToken(t, secret, "main", auth.Claims{Name: "laptop-02"})
+	unknownKid := signToken(t, secret, "gone", auth.Claims{Name: "laptop-02"})
+
+	tests := []struct {
+		name   string
+		req    *transport.Request
+		scheme string
+		key    string
+		want   string
+	}{
+		{"single agent", request("laptop-02", ""), "Bearer", "key", "agent:laptops"},
+		{"single agent named", request("laptop-02", "laptops"), "Bearer", "key", "agent:laptops"},
+		// names the certificate does not match do not make up new targets
+		{"other agent named", request("laptop-02", "servers"), "Bearer", "key", ""},
+		{"unknown agent named", request("laptop-02", "random-1234"), "Bearer", "key", ""},
+		{"several agents", request("laptop-01", ""), "Bearer", "key", ""},
+		{"several agents, one named", request("laptop-01", "laptop-01"), "Bearer", "key", "agent:laptop-01"},
+		{"no certificate", request("", "laptops"), "Bearer", "key", ""},
+		{"ticket", request("laptop-02", ""), "Ticket", "ticket", ""},
+		{"no key", request("laptop-02", ""), "Bearer", "", ""},
+		{"jwt", request("laptop-02", ""), "Bearer", withKid, "cn:laptop-02/jwt:main"},
+		{"jwt of an unknown key", request("laptop-02", ""), "Bearer", unknownKid, "cn:laptop-02/jwt:"},
+		{"jwt without certificate", request("", ""), "Bearer", withKid, ""},
+	}
+
+	for _, tt := range tests {
+		if got := authTarget(tt.req, tt.scheme, tt.key); got != tt.want {
+			t.Errorf("%s: authTarget = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
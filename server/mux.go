@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/easzlab/ezvpn/handoff"
+	"github.com/easzlab/ezvpn/transport"
+)
+
+// startMux listens on addr and serves the agents connecting with the mux
+// transport in the background.
+func startMux(addr string, tlsConfig *tls.Config) {
+	// the listener is inherited from the previous process on upgrade
+	l, err := handoff.Listen("mux", addr)
+	if err != nil {
+		logger.Error("failed to listen", "address", addr, "error", err)
+		os.Exit(1)
+	}
+	l = tls.NewListener(l, tlsConfig)
+
+	logger.Info("mux transport is running", "address", l.Addr().String())
+	go func() {
+		err := transport.ServeMux(l, handleStream)
+		// the listener is closed first on shutdown
+		if !draining.Load() && !errors.Is(err, net.ErrClosed) {
+			logger.Error("mux transport failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// handleStream routes the requests opening the streams of the mux and QUIC
+// transports, as the routes of the websocket transport do.
+func handleStream(req *transport.Request) {
+	if draining.Load() {
+		req.Reject(http.StatusServiceUnavailable, 5*time.Second, "server is shutting down")
+		return
+	}
+
+	switch req.Route {
+	case "/register":
+		handleRegister(req)
+	case "/session":
+		handleSession(req)
+	default:
+		req.Reject(http.StatusNotFound, 0, "unknown route")
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/easzlab/ezvpn/handoff"
+	"github.com/easzlab/ezvpn/transport"
+)
+
+// quicServer serves the agents connecting over QUIC, it is nil unless the
+// QUIC transport is enabled.
+var quicServer atomic.Pointer[transport.QUICServer]
+
+// startQUIC listens on addr and serves the agents connecting with the QUIC
+// transport in the background.
+func startQUIC(addr string, tlsConfig *tls.Config) {
+	// on upgrade the previous process keeps its socket to drain its
+	// connections, both are bound to addr
+	conn, err := handoff.ListenPacket("quic", addr)
+	if err != nil {
+		logger.Error("failed to listen", "address", addr, "error", err)
+		os.Exit(1)
+	}
+	var generation uint8
+	if prev := handoff.State("quic-generation"); len(prev) == 1 {
+		generation = 1 - prev[0]
+	}
+	handoff.SetState("quic-generation", []byte{generation})
+
+	s, err := transport.ListenQUIC(conn, tlsConfig, generation)
+	if err != nil {
+		logger.Error("failed to listen", "address", addr, "error", err)
+		os.Exit(1)
+	}
+	quicServer.Store(s)
+
+	logger.Info("quic transport is running", "address", conn.LocalAddr().String())
+	go func() {
+		err := s.Serve(handleStream)
+		// the listener is closed first on shutdown
+		if !draining.Load() && !errors.Is(err, net.ErrClosed) {
+			logger.Error("quic transport failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+}
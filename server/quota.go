@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/handoff"
+	"github.com/easzlab/ezvpn/usage"
+)
+
+// usageStore counts the traffic of agents against their quotas.
+var usageStore *usage.Store
+
+// initQuotas loads the persisted usage, then persists it and enforces the
+// quotas every config.UsageFlushInterval.
+func initQuotas() {
+	var err error
+	usageStore, err = usage.Open(config.SERVER.UsageFile)
+	if err != nil {
+		logger.Error("failed to load usage", "error", err)
+		os.Exit(1)
+	}
+
+	go mergeUsage()
+
+	go func() {
+		ticker := time.NewTicker(config.UsageFlushInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := usageStore.Flush(); err != nil {
+				logger.Error("failed to persist usage", "error", err)
+			}
+			agents.closeOverQuota()
+		}
+	}()
+}
+
+// quotaExceeded returns which quota of agent is used up, or an empty string.
+func quotaExceeded(agent config.Agent) string {
+	daily, _ := config.ParseSize(agent.DailyQuota)
+	monthly, _ := config.ParseSize(agent.MonthlyQuota)
+	if daily == 0 && monthly == 0 {
+		return ""
+	}
+
+	u := usageStore.Get(agent.Name)
+	if daily > 0 && u.DayBytes.Total() >= daily {
+		return "daily quota exceeded"
+	}
+	if monthly > 0 && u.MonthBytes.Total() >= monthly {
+		return "monthly quota exceeded"
+	}
+	return ""
+}
+
+// mergeUsage adds the usage counted by the process this one took over from
+// on upgrade, once it is drained.
+func mergeUsage() {
+	data := handoff.FinalState("usage")
+	if data == nil {
+		return
+	}
+	var list []usage.Usage
+	if err := json.Unmarshal(data, &list); err != nil {
+		logger.Warn("failed to read the usage of the previous process", "error", err)
+		return
+	}
+	usageStore.Merge(list)
+	logger.Info("usage of the previous process merged", "agents", len(list))
+}
+
+// closeOverQuota closes the control channels of agents whose quota is used
+// up, which tears down their sessions.
+func (r *registry) closeOverQuota() {
+	r.mu.Lock()
+	var exceeded []*controlChannel
+	var reasons []string
+	for id, ch := range r.channels {
+		if reason := quotaExceeded(latest(ch.agent)); reason != "" {
+			exceeded = append(exceeded, ch)
+			reasons = append(reasons, reason)
+			delete(r.channels, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for i, ch := range exceeded {
+		logger.Info("quota exceeded, closing the control channel", "agent", ch.agent.Name, "reason", reasons[i])
+		ch.close(reasons[i])
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/transport"
+	"github.com/easzlab/ezvpn/usage"
+)
+
+func TestQuotaEnforced(t *testing.T) {
+	saved, savedStore := config.AGENTS, usageStore
+	defer func() { config.AGENTS, usageStore = saved, savedStore }()
+
+	file := filepath.Join(t.TempDir(), "usage.json")
+	var err error
+	if usageStore, err = usage.Open(file); err != nil {
+		t.Fatal(err)
+	}
+	daily := config.Agent{Name: "daily", DailyQuota: "1KB"}
+	monthly := config.Agent{Name: "monthly", DailyQuota: "1MB", MonthlyQuota: "2KB"}
+	unlimited := config.Agent{Name: "unlimited"}
+	config.AGENTS = config.AllowedAgents{Agents: []config.Agent{daily, monthly, unlimited}}
+
+	usageStore.Add("daily", 1000, 23)
+	usageStore.Add("monthly", 1024, 1023)
+	usageStore.Add("unlimited", 1<<40, 0)
+	// the usage is enforced after a restart
+	if err := usageStore.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if usageStore, err = usage.Open(file); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		agent config.Agent
+		want  string
+	}{
+		{daily, ""},
+		{monthly, ""},
+		{unlimited, ""},
+	}
+	for _, tt := range tests {
+		if got := quotaExceeded(tt.agent); got != tt.want {
+			t.Errorf("quotaExceeded(%s) = %q, want %q", tt.agent.Name, got, tt.want)
+		}
+	}
+
+	// the last byte of the quotas
+	usageStore.Add("daily", 1, 0)
+	usageStore.Add("monthly", 0, 1)
+	tests = []struct {
+		agent config.Agent
+		want  string
+	}{
+		{daily, "daily quota exceeded"},
+		{monthly, "monthly quota exceeded"},
+		{unlimited, ""},
+	}
+	for _, tt := range tests {
+		if got := quotaExceeded(tt.agent); got != tt.want {
+			t.Errorf("quotaExceeded(%s) = %q, want %q", tt.agent.Name, got, tt.want)
+		}
+	}
+
+	// registered agents over their quota are closed
+	conns := map[string]*fakeConn{}
+	for _, agent := range config.AGENTS.Agents {
+		conns[agent.Name] = &fakeConn{}
+		ch := agents.register(agent, &transport.Request{}, conns[agent.Name])
+		defer agents.unregister(ch)
+	}
+	agents.closeOverQuota()
+	for name, want := range map[string]string{"daily": "daily quota exceeded", "monthly": "monthly quota exceeded", "unlimited": ""} {
+		if got := conns[name].closedFor(); got != want {
+			t.Errorf("control channel of %s closed for %q, want %q", name, got, want)
+		}
+	}
+}
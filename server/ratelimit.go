@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/easzlab/ezvpn/config"
+	"golang.org/x/time/rate"
+)
+
+// minBurst is the smallest burst of a limiter, it must hold a full message.
+const minBurst = 64 * 1024
+
+// bandwidth holds the upload and download token buckets of an agent, shared
+// by all of its sessions. A nil limiter is unlimited.
+type bandwidth struct {
+	up, down *rate.Limiter
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*bandwidth{}
+	// global is the server-wide limit, shared by all agents.
+	global bandwidth
+)
+
+// initLimits sets up the server-wide limit and keeps the agent limits in sync
+// with the config.
+func initLimits() {
+	if config.SERVER.RateLimit != "" {
+		r, err := config.ParseRate(config.SERVER.RateLimit)
+		if err != nil {
+			logger.Error("invalid rate limit", "error", err)
+			os.Exit(1)
+		}
+		global.up, global.down = newLimiter(r), newLimiter(r)
+	}
+	config.OnReload(updateLimits)
+}
+
+// agentBandwidth returns the limiters of agent, creating them on first use.
+func agentBandwidth(agent config.Agent) *bandwidth {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	b, ok := limiters[agent.Name]
+	if !ok {
+		b = &bandwidth{}
+		limiters[agent.Name] = b
+		b.update(agent)
+	}
+	return b
+}
+
+// updateLimits applies the reloaded rate limits to the existing limiters.
+func updateLimits() {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	for _, agent := range config.AGENTS.Agents {
+		if b, ok := limiters[agent.Name]; ok {
+			b.update(agent)
+		}
+	}
+}
+
+// update sets the limits of b from the config of agent. The caller must
+// hold limitersMu.
+func (b *bandwidth) update(agent config.Agent) {
+	up, down := agent.UploadRateLimit, agent.DownloadRateLimit
+	if up == "" {
+		up = agent.RateLimit
+	}
+	if down == "" {
+		down = agent.RateLimit
+	}
+	b.up = setLimit(b.up, up)
+	b.down = setLimit(b.down, down)
+}
+
+// setLimit returns l with its rate set to limit, nil when unlimited.
+func setLimit(l *rate.Limiter, limit string) *rate.Limiter {
+	r, err := config.ParseRate(limit)
+	if err != nil || r == 0 {
+		return nil
+	}
+	if l == nil {
+		return newLimiter(r)
+	}
+	l.SetLimit(rate.Limit(r))
+	l.SetBurst(burst(r))
+	return l
+}
+
+// newLimiter returns a token bucket of r bytes per second.
+func newLimiter(r float64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(r), burst(r))
+}
+
+// burst allows about 100ms worth of traffic at once.
+func burst(r float64) int {
+	if b := int(r / 10); b > minBurst {
+		return b
+	}
+	return minBurst
+}
+
+// waitN blocks until n bytes may pass every limiter.
+func waitN(ctx context.Context, n int, limiters ...*rate.Limiter) error {
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		for left := n; left > 0; {
+			chunk := left
+			if b := l.Burst(); chunk > b {
+				chunk = b
+			}
+			if err := l.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	return nil
+}
+
+// limitedWriter is an io.Writer throttled by the upload limiters of b.
+type limitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	b   *bandwidth
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if err := lw.b.waitUp(lw.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return lw.w.Write(p)
+}
+
+// waitUp blocks until n bytes may be uploaded. The limiters are looked up on
+// every call, so that reloaded limits apply to the live sessions too.
+func (b *bandwidth) waitUp(ctx context.Context, n int) error {
+	up, _ := b.limits()
+	return waitN(ctx, n, up...)
+}
+
+// waitDown blocks until n bytes may be downloaded, see waitUp.
+func (b *bandwidth) waitDown(ctx context.Context, n int) error {
+	_, down := b.limits()
+	return waitN(ctx, n, down...)
+}
+
+// limits returns the upload and download limiters of b, along with the
+// server-wide ones.
+func (b *bandwidth) limits() ([]*rate.Limiter, []*rate.Limiter) {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	return []*rate.Limiter{b.up, global.up}, []*rate.Limiter{b.down, global.down}
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/control"
+	"github.com/easzlab/ezvpn/pki"
+	"github.com/easzlab/ezvpn/transport"
+)
+
+// controlChannel is the registered control channel of an agent. Sessions of
+// the agent are bound to it and torn down when it is closed.
+type controlChannel struct {
+	id    string
+	since time.Time
+	agent config.Agent
+	// chains are the verified chains of the agent certificate, checked
+	// again when the allowed agents or the CRLs are reloaded.
+	chains [][]*x509.Certificate
+	// carrier is the mux session or QUIC connection of the control channel,
+	// closed when the certificate it was handshaked with is revoked.
+	carrier transport.Closer
+	conn    transport.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// mu serializes writes of control messages to conn.
+	mu sync.Mutex
+}
+
+// send writes a control message to the agent.
+func (ch *controlChannel) send(msg control.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.conn.WriteMessage(data)
+}
+
+// close tells the agent why its control channel is closed, then closes it.
+func (ch *controlChannel) close(reason string) {
+	ch.cancel()
+	ch.conn.CloseWithReason(reason)
+}
+
+// rotateTickets sends a fresh session ticket to the agent right away and then
+// every config.TicketRotateInterval, until the control channel is closed.
+func (ch *controlChannel) rotateTickets() {
+	ticker := time.NewTicker(config.TicketRotateInterval)
+	defer ticker.Stop()
+
+	for {
+		if !ch.agent.Expires.IsZero() && time.Now().After(ch.agent.Expires) {
+			logger.Info("credential expired, closing the control channel", "agent", ch.agent.Name)
+			ch.close("credential expired")
+			return
+		}
+
+		t, expires := issueTicket(ch)
+		if err := ch.send(control.Message{Type: control.TypeTicket, Ticket: t, Expires: expires}); err != nil {
+			logger.Warn("failed to send ticket", "agent", ch.agent.Name, "error", err)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ch.ctx.Done():
+			return
+		}
+	}
+}
+
+// registry keeps track of the currently registered agents. Channels are keyed
+// by their ID, an agent may have several of them, e.g. when instances of it
+// share an entry of the allowed agents.
+type registry struct {
+	mu       sync.Mutex
+	channels map[string]*controlChannel
+}
+
+var agents = registry{channels: map[string]*controlChannel{}}
+
+// crls checks agent certificates for revocation, it is nil unless CRL files
+// are configured.
+var crls *pki.CRLChecker
+
+// register records conn, accepted for req, as a control channel of agent.
+// Control channels of the agent registered before are kept, each one is
+// closed when its own connection goes away.
+func (r *registry) register(agent config.Agent, req *transport.Request, conn transport.Conn) *controlChannel {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := &controlChannel{id: newID(), since: time.Now(), agent: agent, carrier: req.Carrier, conn: conn, ctx: ctx, cancel: cancel}
+	if req.TLS != nil {
+		ch.chains = req.TLS.VerifiedChains
+	}
+
+	r.mu.Lock()
+	r.channels[ch.id] = ch
+	registered := 0
+	for _, c := range r.channels {
+		if c.agent.Name == agent.Name {
+			registered++
+		}
+	}
+	r.mu.Unlock()
+
+	if registered > 1 {
+		logger.Info("agent has several control channels", "agent", agent.Name, "channels", registered)
+	}
+
+	go ch.rotateTickets()
+	return ch
+}
+
+// unregister removes ch and cancels the sessions bound to it.
+func (r *registry) unregister(ch *controlChannel) {
+	r.mu.Lock()
+	delete(r.channels, ch.id)
+	r.mu.Unlock()
+
+	ch.cancel()
+}
+
+// channel returns the control channel with the given ID.
+func (r *registry) channel(id string) (*controlChannel, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, ok := r.channels[id]
+	return ch, ok
+}
+
+// lookup returns the latest control channel of the named agent.
+func (r *registry) lookup(name string) (*controlChannel, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var latest *controlChannel
+	for _, ch := range r.channels {
+		if ch.agent.Name == name && (latest == nil || ch.since.After(latest.since)) {
+			latest = ch
+		}
+	}
+	return latest, latest != nil
+}
+
+// broadcast sends msg to all registered agents.
+func (r *registry) broadcast(msg control.Message) {
+	r.mu.Lock()
+	channels := make([]*controlChannel, 0, len(r.channels))
+	for _, ch := range r.channels {
+		channels = append(channels, ch)
+	}
+	r.mu.Unlock()
+
+	for _, ch := range channels {
+		if err := ch.send(msg); err != nil {
+			logger.Warn("failed to send control message", "agent", ch.agent.Name, "type", msg.Type, "error", err)
+		}
+	}
+}
+
+// closeAll closes the control channels of all agents for reason.
+func (r *registry) closeAll(reason string) {
+	r.mu.Lock()
+	channels := r.channels
+	r.channels = map[string]*controlChannel{}
+	r.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.close(reason)
+	}
+}
+
+// revokeRemoved closes the control channels of agents that were removed from
+// the allowed agents, whose auth key was changed or whose certificate no
+// longer matches their approved identity, and of agents holding a JWT signed
+// by a removed key or named like an agent added to the allowed agents. Their tickets become invalid at once, since
+// tickets are bound to a registered control channel.
+func (r *registry) revokeRemoved() {
+	allowed := map[string]config.Agent{}
+	for _, agent := range config.AGENTS.Agents {
+		allowed[agent.Name] = agent
+	}
+
+	r.mu.Lock()
+	var revoked []*controlChannel
+	for id, ch := range r.channels {
+		if !ch.agent.Expires.IsZero() {
+			if !jwtKeyExists(ch.agent.KeyID) || configured(ch.agent.Name) {
+				revoked = append(revoked, ch)
+				delete(r.channels, id)
+			}
+			continue
+		}
+		agent, ok := allowed[ch.agent.Name]
+		if !ok || agent.AuthKey != ch.agent.AuthKey || !verifyIdentity(&tls.ConnectionState{VerifiedChains: ch.chains}, agent) {
+			revoked = append(revoked, ch)
+			delete(r.channels, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, ch := range revoked {
+		logger.Info("agent revoked, closing its control channel", "agent", ch.agent.Name)
+		ch.close("revoked")
+	}
+}
+
+// revokeCertificates closes the control channels of agents whose certificate
+// is revoked by the current CRLs, along with the mux session or QUIC
+// connection they came on, which carries further requests of the agent
+// without handshaking again.
+func (r *registry) revokeCertificates() {
+	r.mu.Lock()
+	var revoked []*controlChannel
+	for id, ch := range r.channels {
+		if crls.RevokedAny(ch.chains) {
+			revoked = append(revoked, ch)
+			delete(r.channels, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, ch := range revoked {
+		logger.Info("certificate revoked, closing the control channel", "agent", ch.agent.Name)
+		ch.close("certificate revoked")
+		if ch.carrier != nil {
+			ch.carrier.CloseWithReason("certificate revoked")
+		}
+	}
+}
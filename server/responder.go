@@ -1,23 +1,35 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/easzlab/ezvpn/audit"
+	"github.com/easzlab/ezvpn/auth"
 	"github.com/easzlab/ezvpn/config"
-	"github.com/gorilla/websocket"
+	"github.com/easzlab/ezvpn/control"
+	"github.com/easzlab/ezvpn/relay"
+	"github.com/easzlab/ezvpn/socks"
+	"github.com/easzlab/ezvpn/transport"
 	"github.com/labstack/echo/v4"
 	"github.com/panjf2000/ants/v2"
 )
 
-// Upgrader is the websocket upgrader.
-var upgrader = websocket.Upgrader{}
+// errNotRegistered is returned for sessions of agents without a control channel.
+var errNotRegistered = errors.New("agent is not registered")
+
+// socksServer serves the sessions of agents.
+var socksServer = &socks.Server{}
 
 // wg and ants.Pool is used to manage goroutines.
 var wg sync.WaitGroup
@@ -28,149 +40,417 @@ func init() {
 	var err error
 	pool, err = ants.NewPool(config.GoroutinePoolSize)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("failed to create the goroutine pool", "error", err)
+		os.Exit(1)
 	}
 }
 
 // Error responds to client with an error. The error is logged and translated
 // to proper HTTP status response.
 func Error(c echo.Context, status int, err error) error {
-	c.Logger().Error(err)
+	logger.Warn("request failed", "remote", c.RealIP(), "route", c.Path(), "status", status, "error", err)
 	return c.JSON(status, map[string]string{"error": err.Error()})
 }
 
-// WebSocket starts websocket session. The handler is invoked in a goroutine.
-func WebSocket(c echo.Context, handler func(ws *websocket.Conn) error) error {
-	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+// GetRegister registers the control channel of an agent over a websocket.
+func GetRegister(c echo.Context) error {
+	return handleRegister(webSocketRequest(c))
+}
+
+// GetSession establishes a session of an agent over a websocket.
+func GetSession(c echo.Context) error {
+	return handleSession(webSocketRequest(c))
+}
+
+// webSocketRequest returns the request of the agent upgrading to a websocket.
+// The auth key of agents using the legacy `/register/<key>` and
+// `/session/<key>` routes is moved to the request header.
+func webSocketRequest(c echo.Context) *transport.Request {
+	req := transport.WebSocketRequest(c.Response(), c.Request(), c.RealIP(), c.Path())
+	if key := c.Param("key"); key != "" {
+		logger.Warn("auth key put in the URL, this is deprecated, please upgrade the agent", "remote", c.RealIP())
+		req.Header = req.Header.Clone()
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	return req
+}
+
+// reject responds to req with an error. The error is logged and sent to the
+// agent, along with when to retry unless retryAfter is 0.
+func reject(req *transport.Request, status int, retryAfter time.Duration, err error) error {
+	logger.Warn("request failed", "remote", req.RemoteIP, "route", req.Route, "status", status, "error", err)
+	return req.Reject(status, retryAfter, err.Error())
+}
+
+// serve runs handler, then closes c telling whether handler failed.
+func serve(req *transport.Request, c transport.Closer, handler func() error) {
+	if err := handler(); err != nil {
+		logger.Error("connection failed", "remote", req.RemoteIP, "route", req.Route, "error", err)
+		c.CloseWithReason("error: " + err.Error())
+		return
+	}
+	c.Close()
+}
+
+// handleRegister registers the control channel of an agent, the sessions of
+// the agent are allowed while it is open.
+func handleRegister(req *transport.Request) error {
+	scheme, key := credential(req)
+	target := authTarget(req, scheme, key)
+	if wait := locks.locked(req.RemoteIP, target); wait > 0 {
+		return tooManyFailures(req, wait)
+	}
+	if certRevoked(req) {
+		return reject(req, http.StatusForbidden, 0, fmt.Errorf("failed to register: certificate revoked"))
+	}
+
+	agent, ok := lookupAgent(req, key)
+	if !ok || scheme != "Bearer" {
+		err := fmt.Errorf("failed to register: invalid auth key or cert identity")
+		return authFailed(req, target, err)
+	}
+
+	locks.succeed(req.RemoteIP, target)
+	if reason := quotaExceeded(agent); reason != "" {
+		return reject(req, http.StatusForbidden, 0, fmt.Errorf("failed to register: %s", reason))
+	}
+
+	conn, err := req.AcceptConn()
 	if err != nil {
-		return Error(c, http.StatusBadRequest, err)
+		logger.Warn("failed to accept the control channel", "agent", agent.Name, "remote", req.RemoteIP, "error", err)
+		return nil
 	}
 
-	go func() {
-		var closeMessage []byte
-
-		if err := handler(ws); err != nil {
-			c.Logger().Error(err)
-
-			closeMessage = websocket.FormatCloseMessage(
-				websocket.ClosePolicyViolation, "error: "+err.Error(),
-			)
-		} else {
-			closeMessage = websocket.FormatCloseMessage(
-				websocket.CloseNormalClosure, "",
-			)
+	logger.Info("agent registered", "agent", agent.Name, "remote", req.RemoteIP)
+	go serve(req, conn, func() error {
+		ch := agents.register(agent, req, conn)
+		defer agents.unregister(ch)
+		err := readControl(conn)
+		if ch.ctx.Err() != nil {
+			// closed by the server, the agent was told why
+			return nil
 		}
+		return err
+	})
+	return nil
+}
 
-		ws.WriteControl(
-			websocket.CloseMessage, closeMessage, time.Now().Add(config.WsCloseTimeout),
-		)
-		ws.Close()
-	}()
+// handleSession establishes a session of a registered agent, which is
+// tunneled to the socks server.
+func handleSession(req *transport.Request) error {
+	var ch *controlChannel
+	var err error
+
+	scheme, value := credential(req)
+	target := authTarget(req, scheme, value)
+	if wait := locks.locked(req.RemoteIP, target); wait > 0 {
+		return tooManyFailures(req, wait)
+	}
+	if certRevoked(req) {
+		return reject(req, http.StatusForbidden, 0, fmt.Errorf("failed to establish session: certificate revoked"))
+	}
+
+	switch scheme {
+	case "Ticket":
+		ch, err = ticketChannel(value)
+	case "Bearer":
+		ch, err = keyChannel(req, value)
+	default:
+		err = fmt.Errorf("missing credential")
+	}
+	if errors.Is(err, errNotRegistered) {
+		return reject(req, http.StatusForbidden, 0, fmt.Errorf("failed to establish session: %s", err))
+	}
+	if err != nil {
+		return authFailed(req, target, fmt.Errorf("failed to establish session: %s", err))
+	}
+
+	// the identity approved for the agent may have been narrowed by a
+	// reload since it registered
+	agent := latest(ch.agent)
+	if !verifyIdentity(req.TLS, agent) {
+		err := fmt.Errorf("failed to establish session: invalid cert identity")
+		return authFailed(req, target, err)
+	}
+
+	locks.succeed(req.RemoteIP, target)
+	if reason := quotaExceeded(agent); reason != "" {
+		return reject(req, http.StatusForbidden, 0, fmt.Errorf("failed to establish session: %s", reason))
+	}
+
+	// session limits are checked before the session is accepted, so that the
+	// agent gets a 429 instead of a session closed right away
+	if err := acquireSession(agent); err != nil {
+		return reject(req, http.StatusTooManyRequests, time.Second, fmt.Errorf("failed to establish session: %s", err))
+	}
+	rec := newRecord(agent, req.TLS, req.RemoteIP)
+	stream, err := req.AcceptStream(rec.SessionID, agent.Compression)
+	if err != nil {
+		releaseSession(agent)
+		logger.Warn("failed to accept the session", "agent", agent.Name, "remote", req.RemoteIP, "error", err)
+		return nil
+	}
 
+	logger.Info("session established", "agent", agent.Name, "session_id", rec.SessionID, "remote", req.RemoteIP)
+	go serve(req, stream, func() error {
+		defer releaseSession(agent)
+		return tunnel(ch.ctx, stream, agent, rec)
+	})
 	return nil
 }
 
-func GetRegister(c echo.Context) error {
-	key := c.Param("key")
-	if key != "" {
-		for _, agent := range config.AGENTS.Agents {
-			// check if the key is valid
-			if key == agent.AuthKey {
-				// check CN if mTLS is enabled
-				if c.Request().TLS != nil && len(c.Request().TLS.PeerCertificates) > 0 {
-					cn := c.Request().TLS.PeerCertificates[0].Subject.CommonName
-					for _, approved_cn := range agent.ApprovedCNs {
-						if cn == approved_cn {
-							log.Printf("agent %s@%s registered", agent.Name, c.RealIP())
-							return WebSocket(c, func(ws *websocket.Conn) error {
-								return readFromWS(ws)
-							})
-						}
-					}
-				}
-			}
+// latest returns the current config of agent, which may have been reloaded
+// since its control channel was registered. Agents authenticated by a JWT
+// are described by their token and returned as is.
+func latest(agent config.Agent) config.Agent {
+	if !agent.Expires.IsZero() {
+		return agent
+	}
+	for _, a := range config.AGENTS.Agents {
+		if a.Name == agent.Name {
+			return a
 		}
 	}
-	err := fmt.Errorf("failed to register: invalid auth key(%s) or cert CN", key)
-	return Error(c, http.StatusUnauthorized, err)
+	return agent
 }
 
-func GetSession(c echo.Context) error {
-	key := c.Param("key")
-	if key != "" {
-		for _, agent := range config.AGENTS.Agents {
-			// check if the key is valid
-			if key == agent.AuthKey {
-				log.Printf("agent %s@%s session established", agent.Name, c.RealIP())
-				return WebSocket(c, func(ws *websocket.Conn) error {
-					return tunnel(ws)
-				})
-			}
+// certRevoked reports whether the certificate req came with is revoked. The
+// TLS handshake refuses revoked certificates, but a mux session or QUIC
+// connection is handshaked once for all the requests it carries.
+func certRevoked(req *transport.Request) bool {
+	return crls != nil && req.TLS != nil && crls.RevokedAny(req.TLS.VerifiedChains)
+}
+
+// allowedDestinations returns the destinations allowed to agent, its own
+// along with those of its groups. Agents without any may reach every
+// destination.
+func allowedDestinations(agent config.Agent) []string {
+	destinations := agent.AllowedDestinations
+	for _, group := range config.AGENTS.Groups {
+		if slices.Contains(agent.Groups, group.Name) {
+			destinations = append(slices.Clip(destinations), group.AllowedDestinations...)
+		}
+	}
+	return destinations
+}
+
+// authFailed records a failed auth targeting the identity target and
+// responds with err.
+func authFailed(req *transport.Request, target string, err error) error {
+	locks.fail(req.RemoteIP, target)
+	return reject(req, http.StatusUnauthorized, 0, err)
+}
+
+// tooManyFailures responds to a client locked out after too many failed auths.
+func tooManyFailures(req *transport.Request, wait time.Duration) error {
+	err := fmt.Errorf("too many failed auths, retry in %s", wait.Round(time.Second))
+	return reject(req, http.StatusTooManyRequests, wait, err)
+}
+
+// ticketChannel returns the control channel a session ticket was issued for,
+// or the one the agent registered here for a ticket of the previous process.
+func ticketChannel(value string) (*controlChannel, error) {
+	t, err := verifyTicket(value)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, ok := agents.channel(t.Channel)
+	if !ok && t.Issued < started.Unix() {
+		// the ticket was issued by the previous process before an upgrade,
+		// the sessions go to the control channel the agent has here
+		if ch, ok = agents.lookup(t.Agent); !ok {
+			return nil, fmt.Errorf("agent %s: %w", t.Agent, errNotRegistered)
+		}
+	}
+	if !ok || ch.agent.Name != t.Agent {
+		return nil, fmt.Errorf("ticket of agent %s is no longer valid", t.Agent)
+	}
+	return ch, nil
+}
+
+// keyChannel returns the control channel of the agent owning key, this is
+// used by agents that do not support session tickets.
+func keyChannel(req *transport.Request, key string) (*controlChannel, error) {
+	agent, ok := lookupAgent(req, key)
+	if !ok {
+		return nil, fmt.Errorf("invalid auth key")
+	}
+
+	// sessions are only allowed while the agent has a control channel
+	ch, ok := agents.lookup(agent.Name)
+	if !ok {
+		return nil, fmt.Errorf("agent %s: %w", agent.Name, errNotRegistered)
+	}
+	return ch, nil
+}
+
+// credential returns the credential presented by the agent and its scheme.
+// It is taken from the `Authorization` header, which is either
+// `Bearer <auth key>` or `Ticket <session ticket>`.
+func credential(req *transport.Request) (string, string) {
+	scheme, value, found := strings.Cut(req.Header.Get(echo.HeaderAuthorization), " ")
+	if !found {
+		return "", ""
+	}
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		return "Bearer", strings.TrimSpace(value)
+	case strings.EqualFold(scheme, "Ticket"):
+		return "Ticket", strings.TrimSpace(value)
+	}
+	return "", ""
+}
+
+// lookupAgent returns the allowed agent whose auth key matches key and whose
+// cert identity matches the client certificate of req. Keys are verified
+// against the single agent left once the candidates are narrowed down by cert
+// identity and by the agent name sent in the request, if any, so that at most
+// one slow hash is computed per request. Keys verified recently are matched
+// from the cache, see auth.IsVerified. A JWT credential is verified against
+// the JWT keys instead, its claims describe the agent.
+func lookupAgent(req *transport.Request, key string) (config.Agent, bool) {
+	if key == "" {
+		return config.Agent{}, false
+	}
+
+	if auth.IsToken(key) && len(config.AGENTS.JWTKeys) > 0 {
+		agent, err := agentFromToken(key)
+		if err != nil {
+			logger.Info("invalid jwt credential", "error", err)
+			return config.Agent{}, false
+		}
+		return agent, verifyIdentity(req.TLS, agent)
+	}
+
+	candidates := candidateAgents(req)
+	for _, agent := range candidates {
+		if auth.IsVerified(agent.AuthKey, key) {
+			return agent, true
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return config.Agent{}, false
+	case 1:
+		return candidates[0], auth.VerifyKey(candidates[0].AuthKey, key)
+	default:
+		logger.Warn("several agents match the cert identity, the agent must send its name",
+			"remote", req.RemoteIP, "agents", len(candidates))
+		return config.Agent{}, false
+	}
+}
+
+// candidateAgents returns the allowed agents matching the cert identity of
+// req and the agent name sent in the request, if any.
+func candidateAgents(req *transport.Request) []config.Agent {
+	name := req.Header.Get(control.HeaderAgentName)
+	var candidates []config.Agent
+	for _, agent := range config.AGENTS.Agents {
+		if (name == "" || agent.Name == name) && verifyIdentity(req.TLS, agent) {
+			candidates = append(candidates, agent)
 		}
 	}
-	err := fmt.Errorf("failed to establish session: invalid auth key: %s", key)
-	return Error(c, http.StatusUnauthorized, err)
+	return candidates
 }
 
-// readFromWS reads from ws continuously, the agent side will send the ws ping message regularly
-func readFromWS(ws *websocket.Conn) error {
+// readControl reads from the control channel conn until it is closed, the
+// agent checks it regularly with keepalives.
+func readControl(conn transport.Conn) error {
 	for {
-		_, _, err := ws.ReadMessage()
+		_, err := conn.ReadMessage()
+		if errors.Is(err, transport.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func tunnel(ws *websocket.Conn) error {
+// tunnel proxies the session stream to the socks server until either side
+// closes or ctx, the lifetime of the agent's control channel, is done. The
+// socks server runs in-process, so that the destinations of agent can be
+// enforced and recorded in rec.
+func tunnel(ctx context.Context, stream transport.Stream, agent config.Agent, rec *audit.Record) error {
+	log := logger.With("agent", rec.Agent, "session_id", rec.SessionID, "remote", rec.Source)
+
+	// the session is recorded once both the tunnel and the socks server are
+	// done with it
+	var upBytes, downBytes atomic.Int64
+	served := make(chan *socks.Request, 1)
+	defer func() {
+		go func() {
+			req := <-served
+			rec.BytesUp, rec.BytesDown = upBytes.Load(), downBytes.Load()
+			writeRecord(rec, req)
+		}()
+	}()
+
 	// connection to the socks5 server.
-	conn, err := net.DialTimeout("tcp", config.SERVER.SocksServer, config.NetDialTimeout)
-	if err != nil {
-		return err
-	}
+	conn, socksConn := net.Pipe()
 	defer conn.Close()
 
+	var rule socks.Rule
+	if destinations := allowedDestinations(agent); len(destinations) > 0 {
+		rule = socks.AllowDestinations(destinations)
+	}
+
+	// with compress_ports, the traffic to the agent is only compressed for
+	// these destination ports, known once the socks request is checked
+	down := stream
+	if ports, _ := config.ParsePorts(agent.CompressPorts); len(ports) > 0 && stream.Compressed() {
+		ps := &portStream{Stream: stream, ports: ports}
+		rule, down = ps.rule(rule), ps
+	}
+	go func() {
+		req, _ := socksServer.ServeConn(socksConn, rule, socksLogger.With(
+			"agent", rec.Agent, "session_id", rec.SessionID, "remote", rec.Source,
+		))
+		served <- req
+	}()
+
+	// bandwidth of the agent, shared by all of its sessions
+	bw := agentBandwidth(agent)
+
+	// tear down the session once the control channel is gone
+	end := make(chan struct{})
+	defer close(end)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-end:
+		}
+	}()
+
 	errCh := make(chan error, 2)
 
-	// uplink: Agent --ws--> Server --conn--> (socks server)
+	// uplink: Agent --stream--> Server --conn--> (socks server)
 	uplink := func() {
 		func(c chan error) {
-			buf := make([]byte, config.BufferSize)
-
-			for {
-				_, r, err := ws.NextReader()
-				if err != nil {
-					c <- err
-					return
-				}
-
-				if _, err := io.CopyBuffer(conn, r, buf); err != nil {
-					c <- err
-					return
-				}
-			}
+			w := &limitedWriter{ctx: ctx, w: conn, b: bw}
+			c <- relay.Receive(stream, w, func(n int64) {
+				usageStore.Add(agent.Name, n, 0)
+				upBytes.Add(n)
+			})
 		}(errCh)
 
 		wg.Done()
 	}
 
-	// Downlink: Agent <--ws-- Server <--conn--(socks server)
+	// Downlink: Agent <--stream-- Server <--conn--(socks server)
 	downlink := func() {
 		func(c chan error) {
-			buf := make([]byte, config.BufferSize)
-
-			for {
-				n, err := conn.Read(buf)
-				if err != nil {
-					c <- err
-					return
+			c <- relay.Send(down, conn, func(n int) error {
+				if err := bw.waitDown(ctx, n); err != nil {
+					return err
 				}
-
-				if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-					c <- err
-					return
-				}
-			}
+				usageStore.Add(agent.Name, 0, int64(n))
+				downBytes.Add(int64(n))
+				return nil
+			})
 		}(errCh)
 
 		wg.Done()
@@ -187,21 +467,21 @@ func tunnel(ws *websocket.Conn) error {
 		err := <-errCh
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				log.Println("Destination closed. Finishing session")
+				log.Info("destination closed, finishing session")
 				return nil
 			}
 
-			if errors.Is(err, net.ErrClosed) {
-				log.Println("Canceled. Finishing session")
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, context.Canceled) {
+				log.Info("canceled, finishing session")
 				return nil
 			}
 
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				log.Println("Tunnel closed. Finishing session")
+			if errors.Is(err, transport.ErrClosed) {
+				log.Info("tunnel closed, finishing session")
 				return nil
 			}
 
-			log.Printf("Error %q. Killing session", err)
+			log.Warn("killing session", "error", err)
 
 			return err
 		}
@@ -2,50 +2,196 @@ package server
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/handoff"
+	"github.com/easzlab/ezvpn/logging"
+	"github.com/easzlab/ezvpn/pki"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-// Start starts tunneling server with given configuration.
-func Start() error {
+// logger is the logger of the server component, httpLogger logs the
+// requests and socksLogger the sessions served by the in-process socks server.
+var (
+	logger      = logging.Component(logging.Server)
+	httpLogger  = logging.Component(logging.HTTP)
+	socksLogger = logging.Component(logging.Socks)
+)
+
+// ipExtractor returns how the client IP is found: the peer address, or the
+// X-Forwarded-For header when it is set by one of the trusted proxies.
+func ipExtractor() echo.IPExtractor {
+	if len(config.SERVER.TrustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range config.SERVER.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			logger.Error("invalid trusted proxy", "proxy", proxy, "error", err)
+			os.Exit(1)
+		}
+		options = append(options, echo.TrustIPRange(cidr))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// newEcho returns an echo instance logging its requests, recovering from
+// panics and refusing requests while draining, with the client IP found as
+// configured.
+func newEcho() *echo.Echo {
 	e := echo.New()
 	e.HideBanner = true
+	e.IPExtractor = ipExtractor()
 
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
+	// log the matched route instead of the request URI, so that auth keys
+	// sent by legacy agents never end up in the access log
+	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogRoutePath: true,
+		LogMethod:    true,
+		LogStatus:    true,
+		LogRemoteIP:  true,
+		LogLatency:   true,
+		LogUserAgent: true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			httpLogger.Info("request",
+				"method", v.Method, "route", v.RoutePath, "status", v.Status,
+				"remote", v.RemoteIP, "latency", v.Latency, "user_agent", v.UserAgent,
+			)
+			return nil
+		},
+	}))
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
+		LogErrorFunc: func(c echo.Context, err error, stack []byte) error {
+			httpLogger.Error("panic recovered", "route", c.Path(), "error", err, "stack", string(stack))
+			return err
+		},
+	}))
+	e.Use(refuseWhileDraining)
+	return e
+}
 
-	e.GET("/register/:key", GetRegister)
-	e.GET("/session/:key", GetSession)
+// Start starts tunneling server with given configuration.
+func Start() error {
+	compilePatterns()
+	config.OnReload(compilePatterns)
+	config.OnReload(agents.revokeRemoved)
+	initLimits()
+	initQuotas()
+	initAudit()
+	initTickets()
+	go locks.pruneEvery(config.AuthPruneInterval)
 
-	s := http.Server{
+	e := newEcho()
+	e.GET("/register", GetRegister)
+	e.GET("/session", GetSession)
+
+	if config.SERVER.LegacyAuth {
+		e.GET("/register/:key", GetRegister)
+		e.GET("/session/:key", GetSession)
+	}
+
+	// the listener is inherited from the previous process on upgrade
+	l, err := handoff.Listen("control", config.SERVER.ControlAddress)
+	if err != nil {
+		return err
+	}
+	s := &http.Server{
 		Addr:    config.SERVER.ControlAddress,
 		Handler: e,
 	}
+	httpServer.Store(s)
 
 	if config.SERVER.EnableTLS {
-		// load CA certificate file
-		caCertFile, err := os.ReadFile(config.SERVER.CaFile)
+		// certificates and CA are reloaded when they change on disk
+		certs, err := pki.NewReloader(config.SERVER.CertFile, config.SERVER.KeyFile, config.SERVER.CaFile)
 		if err != nil {
-			log.Fatalf("error reading CA certificate: %v", err)
+			logger.Error("failed to load certificates", "error", err)
+			os.Exit(1)
 		}
-		certPool := x509.NewCertPool()
-		certPool.AppendCertsFromPEM(caCertFile)
 
-		s.TLSConfig = &tls.Config{
-			ClientAuth: tls.RequireAndVerifyClientCert,
-			ClientCAs:  certPool,
-			MinVersion: tls.VersionTLS12,
+		// agents with a revoked certificate are rejected, and disconnected
+		// when their certificate gets revoked
+		if len(config.SERVER.CRLFiles) > 0 {
+			crls, err = pki.NewCRLChecker(config.SERVER.CRLFiles, agents.revokeCertificates)
+			if err != nil {
+				logger.Error("failed to load CRLs", "error", err)
+				os.Exit(1)
+			}
+		}
+
+		s.TLSConfig = newTLSConfig(certs, tls.RequireAndVerifyClientCert)
+
+		// enrollment is enabled when the built-in CA is available
+		if config.SERVER.CADir != "" {
+			startEnroll(config.SERVER.EnrollAddress, newTLSConfig(certs, tls.NoClientCert))
 		}
-		log.Println("ezvpn server is running on: " + config.SERVER.ControlAddress)
-		return s.ListenAndServeTLS(config.SERVER.CertFile, config.SERVER.KeyFile)
+		if config.SERVER.MuxAddress != "" {
+			startMux(config.SERVER.MuxAddress, newTLSConfig(certs, tls.RequireAndVerifyClientCert))
+		}
+		if config.SERVER.QUICAddress != "" {
+			startQUIC(config.SERVER.QUICAddress, newTLSConfig(certs, tls.RequireAndVerifyClientCert))
+		}
+		logger.Info("ezvpn server is running", "address", l.Addr().String())
+		handoff.Ready()
+		err = s.ServeTLS(l, "", "")
 	} else {
-		log.Println("ezvpn server is running on: " + config.SERVER.ControlAddress)
-		return s.ListenAndServe()
+		if config.SERVER.CADir != "" {
+			startEnroll(config.SERVER.EnrollAddress, nil)
+		}
+		if config.SERVER.MuxAddress != "" {
+			logger.Error("the mux transport requires TLS")
+			os.Exit(1)
+		}
+		if config.SERVER.QUICAddress != "" {
+			logger.Error("the QUIC transport requires TLS")
+			os.Exit(1)
+		}
+		logger.Info("ezvpn server is running", "address", l.Addr().String())
+		handoff.Ready()
+		err = s.Serve(l)
+	}
+
+	// the listener is closed first on shutdown
+	if draining.Load() {
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+// newTLSConfig returns the TLS config of a listener of agents, verifying
+// their certificates as clientAuth tells against the reloaded CA and the CRLs.
+func newTLSConfig(certs *pki.Reloader, clientAuth tls.ClientAuthType) *tls.Config {
+	c := &tls.Config{
+		ClientAuth:     clientAuth,
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if crls != nil {
+		c.VerifyConnection = crls.VerifyConnection
+	}
+	c.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		clone := c.Clone()
+		clone.GetConfigForClient = nil
+		clone.ClientCAs = certs.CAPool()
+		return clone, nil
 	}
+	return c
 }
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/easzlab/ezvpn/config"
+	"golang.org/x/time/rate"
+)
+
+// sessionCount tracks the sessions of an agent against its session limits.
+type sessionCount struct {
+	active int
+	// newSessions is the rate of new sessions, nil is unlimited.
+	newSessions *rate.Limiter
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*sessionCount{}
+)
+
+// acquireSession accounts a new session of agent, it fails when the agent is
+// at its max_sessions or max_new_sessions_per_second. An acquired session
+// must be released with releaseSession.
+func acquireSession(agent config.Agent) error {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	s, ok := sessions[agent.Name]
+	if !ok {
+		s = &sessionCount{}
+		sessions[agent.Name] = s
+	}
+
+	if agent.MaxSessions > 0 && s.active >= agent.MaxSessions {
+		return fmt.Errorf("too many sessions, max %d", agent.MaxSessions)
+	}
+
+	// the limiter follows the configured rate, which may have been reloaded
+	if r := agent.MaxNewSessionsPerSecond; r > 0 {
+		burst := int(math.Ceil(r))
+		if s.newSessions == nil || s.newSessions.Limit() != rate.Limit(r) {
+			s.newSessions = rate.NewLimiter(rate.Limit(r), burst)
+		}
+		if !s.newSessions.Allow() {
+			return fmt.Errorf("too many new sessions, max %g per second", r)
+		}
+	} else {
+		s.newSessions = nil
+	}
+
+	s.active++
+	return nil
+}
+
+// activeSessions returns the number of active sessions of all agents.
+func activeSessions() int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	n := 0
+	for _, s := range sessions {
+		n += s.active
+	}
+	return n
+}
+
+// releaseSession accounts the end of a session of agent.
+func releaseSession(agent config.Agent) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	if s, ok := sessions[agent.Name]; ok {
+		s.active--
+		if s.active <= 0 && s.newSessions == nil {
+			delete(sessions, agent.Name)
+		}
+	}
+}
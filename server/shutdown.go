@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/control"
+	"github.com/easzlab/ezvpn/handoff"
+	"github.com/labstack/echo/v4"
+)
+
+// draining is set once the server is shutting down, new registrations and
+// sessions are refused from then on.
+var draining atomic.Bool
+
+// httpServer is the server started by Start.
+var httpServer atomic.Pointer[http.Server]
+
+// refuseWhileDraining responds 503 to all requests once the server is
+// shutting down.
+func refuseWhileDraining(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if draining.Load() {
+			c.Response().Header().Set("Retry-After", "5")
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "server is shutting down"})
+		}
+		return next(c)
+	}
+}
+
+// Shutdown gracefully shuts the server down: it stops accepting registrations
+// and sessions, tells the agents it is going away, and waits up to drain for
+// the active sessions to finish before closing the remaining ones and the
+// server itself. After an upgrade, the new process keeps accepting on the
+// listeners closed here, and on its own QUIC socket.
+func Shutdown(drain time.Duration) error {
+	draining.Store(true)
+	handoff.Close()
+	if s := quicServer.Load(); s != nil {
+		s.Stop()
+	}
+	logger.Info("shutting down, draining sessions", "timeout", drain, "sessions", activeSessions())
+
+	agents.broadcast(control.Message{Type: control.TypeShutdown, Reason: "server is shutting down"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := waitSessions(ctx); err != nil {
+		logger.Warn("drain timeout reached, closing the remaining sessions", "sessions", activeSessions())
+	}
+
+	// closing the control channels ends the remaining sessions
+	agents.closeAll("server shut down")
+	if s := quicServer.Load(); s != nil {
+		s.Close("server shut down")
+	}
+
+	if usageStore != nil {
+		if err := usageStore.Flush(); err != nil {
+			logger.Error("failed to persist usage", "error", err)
+		}
+		// after an upgrade, the usage counted while draining is added up by
+		// the new process
+		if data, err := json.Marshal(usageStore.Deltas()); err == nil {
+			handoff.SetFinalState("usage", data)
+		}
+	}
+	if err := handoff.Finish(); err != nil {
+		logger.Error("failed to pass the usage to the new process", "error", err)
+	}
+
+	s := httpServer.Load()
+	if s == nil {
+		return nil
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), config.WsCloseTimeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+// Upgrade starts a new process taking over the listeners, see
+// handoff.Upgrade, and returns its PID once it is ready. The usage is
+// persisted right before, so that the new process loads the current usage
+// and is the only one writing it from then on; the usage counted by this
+// process while draining is passed to it by Shutdown. This process persists
+// the usage again if the upgrade fails.
+func Upgrade() (int, error) {
+	if usageStore != nil {
+		if err := usageStore.Freeze(); err != nil {
+			return 0, fmt.Errorf("failed to persist usage: %v", err)
+		}
+	}
+	pid, err := handoff.Upgrade(config.UpgradeTimeout)
+	if err != nil && usageStore != nil {
+		usageStore.Thaw()
+	}
+	return pid, err
+}
+
+// waitSessions waits until no session is active, or ctx is done.
+func waitSessions(ctx context.Context) error {
+	ticker := time.NewTicker(config.ShutdownPollInterval)
+	defer ticker.Stop()
+
+	for activeSessions() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
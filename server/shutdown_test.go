@@ -0,0 +1,53 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/easzlab/ezvpn/usage"
+)
+
+// envChild set to exit makes the test binary exit right away, as a new
+// process failing an upgrade.
+const envChild = "EZVPN_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envChild) == "exit" {
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestUpgradeFailedThawsUsage(t *testing.T) {
+	saved := usageStore
+	defer func() { usageStore = saved }()
+
+	file := filepath.Join(t.TempDir(), "usage.json")
+	var err error
+	if usageStore, err = usage.Open(file); err != nil {
+		t.Fatal(err)
+	}
+	usageStore.Add("laptop-01", 1, 1)
+
+	t.Setenv(envChild, "exit")
+	if _, err := Upgrade(); err == nil {
+		t.Fatal("Upgrade succeeded with a new process exiting")
+	}
+
+	// this process keeps persisting the usage
+	usageStore.Add("laptop-01", 1, 1)
+	if err := usageStore.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := usage.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Get("laptop-01").DayBytes; got != (usage.Counter{Up: 2, Down: 2}) {
+		t.Fatalf("usage persisted after the failed upgrade = %+v, want 2 bytes each way", got)
+	}
+	if deltas := usageStore.Deltas(); len(deltas) != 0 {
+		t.Fatalf("usage still kept apart after the failed upgrade: %+v", deltas)
+	}
+}
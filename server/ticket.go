@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/handoff"
+)
+
+// ticketSecret signs session tickets. It is passed on to the new process on
+// upgrade, tickets issued by a previous run are otherwise invalid.
+var ticketSecret = make([]byte, 32)
+
+func init() {
+	if _, err := rand.Read(ticketSecret); err != nil {
+		logger.Error("failed to create the ticket secret", "error", err)
+		os.Exit(1)
+	}
+}
+
+// initTickets takes over the ticket secret of the previous process on
+// upgrade, so that the tickets it issued stay valid, and passes it on.
+func initTickets() {
+	if secret := handoff.State("ticket-secret"); len(secret) == len(ticketSecret) {
+		ticketSecret = secret
+	}
+	handoff.SetState("ticket-secret", ticketSecret)
+}
+
+// started is when this process started, tickets issued before were issued by
+// the previous process.
+var started = time.Now()
+
+// ticket is the payload of a session ticket. It binds the ticket to one
+// control channel of an agent.
+type ticket struct {
+	Agent   string `json:"agent"`
+	Channel string `json:"channel"`
+	Issued  int64  `json:"iat"`
+	Expires int64  `json:"exp"`
+}
+
+// newID returns a random hex encoded ID.
+func newID() string {
+	b := make([]byte, config.SessionIDSize)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// issueTicket returns a signed ticket for the sessions of ch.
+func issueTicket(ch *controlChannel) (string, time.Time) {
+	now := time.Now()
+	expires := now.Add(config.TicketTTL)
+	if !ch.agent.Expires.IsZero() && ch.agent.Expires.Before(expires) {
+		expires = ch.agent.Expires
+	}
+	payload, _ := json.Marshal(ticket{
+		Agent:   ch.agent.Name,
+		Channel: ch.id,
+		Issued:  now.Unix(),
+		Expires: expires.Unix(),
+	})
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + sign(encoded), expires
+}
+
+// verifyTicket checks the signature and expiry of s and returns its payload.
+func verifyTicket(s string) (ticket, error) {
+	var t ticket
+
+	encoded, signature, found := strings.Cut(s, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(sign(encoded))) {
+		return t, errors.New("invalid ticket signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return t, err
+	}
+
+	if time.Now().Unix() > t.Expires {
+		return t, errors.New("ticket expired")
+	}
+	return t, nil
+}
+
+// sign returns the HMAC-SHA256 signature of s.
+func sign(s string) string {
+	mac := hmac.New(sha256.New, ticketSecret)
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/transport"
+)
+
+// fakeConn is a control channel recording why it was closed.
+type fakeConn struct {
+	mu     sync.Mutex
+	reason string
+}
+
+func (c *fakeConn) Close() error                 { return nil }
+func (c *fakeConn) ReadMessage() ([]byte, error) { select {} }
+func (c *fakeConn) WriteMessage([]byte) error    { return nil }
+
+func (c *fakeConn) CloseWithReason(reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reason = reason
+	return nil
+}
+
+func (c *fakeConn) closedFor() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason
+}
+
+func TestTicketIssueAndVerify(t *testing.T) {
+	ch := &controlChannel{id: newID(), agent: config.Agent{Name: "laptop-01"}}
+
+	s, expires := issueTicket(ch)
+	if got := time.Until(expires); got <= 0 || got > config.TicketTTL {
+		t.Fatalf("ticket expires in %s, want within %s", got, config.TicketTTL)
+	}
+
+	tk, err := verifyTicket(s)
+	if err != nil {
+		t.Fatalf("verifyTicket: %v", err)
+	}
+	if tk.Agent != "laptop-01" || tk.Channel != ch.id {
+		t.Fatalf("verifyTicket = %+v, want agent laptop-01 and channel %s", tk, ch.id)
+	}
+}
+
+func TestTicketTampered(t *testing.T) {
+	ch := &controlChannel{id: newID(), agent: config.Agent{Name: "laptop-01"}}
+	s, _ := issueTicket(ch)
+	other, _ := issueTicket(&controlChannel{id: newID(), agent: config.Agent{Name: "laptop-02"}})
+
+	payload, signature, _ := strings.Cut(s, ".")
+	otherPayload, _, _ := strings.Cut(other, ".")
+
+	for name, value := range map[string]string{
+		"swapped payload":   otherPayload + "." + signature,
+		"missing signature": payload,
+		"empty":             "",
+		"bad signature":     payload + ".AAAA",
+	} {
+		if _, err := verifyTicket(value); err == nil {
+			t.Errorf("%s: verifyTicket succeeded", name)
+		}
+	}
+}
+
+func TestTicketExpired(t *testing.T) {
+	// tickets never outlive the credential of the agent
+	ch := &controlChannel{id: newID(), agent: config.Agent{Name: "laptop-01", Expires: time.Now().Add(-time.Minute)}}
+
+	s, _ := issueTicket(ch)
+	if _, err := verifyTicket(s); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("verifyTicket error = %v, want ticket expired", err)
+	}
+}
+
+func TestTicketRevokedOnReload(t *testing.T) {
+	saved := config.AGENTS
+	defer func() { config.AGENTS = saved }()
+
+	agent := config.Agent{Name: "laptop-01", AuthKey: "sha256:00"}
+	config.AGENTS = config.AllowedAgents{Agents: []config.Agent{agent}}
+
+	conn := &fakeConn{}
+	ch := agents.register(agent, &transport.Request{}, conn)
+	defer agents.unregister(ch)
+
+	s, _ := issueTicket(ch)
+	if _, err := ticketChannel(s); err != nil {
+		t.Fatalf("ticketChannel before reload: %v", err)
+	}
+
+	// the auth key of the agent is changed by a reload
+	config.AGENTS = config.AllowedAgents{Agents: []config.Agent{{Name: "laptop-01", AuthKey: "sha256:01"}}}
+	agents.revokeRemoved()
+
+	if _, err := ticketChannel(s); err == nil {
+		t.Fatal("ticketChannel succeeded after the agent was revoked")
+	}
+	if reason := conn.closedFor(); reason != "revoked" {
+		t.Fatalf("control channel closed for %q, want revoked", reason)
+	}
+}
+
+func TestTicketOfPreviousProcess(t *testing.T) {
+	saved := config.AGENTS
+	defer func() { config.AGENTS = saved }()
+
+	agent := config.Agent{Name: "laptop-01", AuthKey: "sha256:00"}
+	config.AGENTS = config.AllowedAgents{Agents: []config.Agent{agent}}
+
+	// a ticket issued by this process is bound to its control channel
+	gone := &controlChannel{id: newID(), agent: agent}
+	s, _ := issueTicket(gone)
+	if _, err := ticketChannel(s); err == nil {
+		t.Fatal("ticketChannel succeeded for an unknown control channel")
+	}
+
+	// a ticket issued before an upgrade goes to the channel registered here
+	defer func(s time.Time) { started = s }(started)
+	started = time.Now().Add(time.Minute)
+	if _, err := ticketChannel(s); !errors.Is(err, errNotRegistered) {
+		t.Fatalf("ticketChannel error = %v, want not registered", err)
+	}
+
+	ch := agents.register(agent, &transport.Request{}, &fakeConn{})
+	defer agents.unregister(ch)
+	got, err := ticketChannel(s)
+	if err != nil {
+		t.Fatalf("ticketChannel: %v", err)
+	}
+	if got != ch {
+		t.Fatalf("ticketChannel = %s, want %s", got.id, ch.id)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/easzlab/ezvpn/auth"
+	"github.com/easzlab/ezvpn/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// agentFromToken verifies a JWT credential against the configured JWT keys
+// and returns the agent described by its claims. A token naming its key is
+// verified against that key, otherwise against every key of its alg, so that
+// tokens of a rotated key are still accepted while both keys are configured.
+// The name claim may not be the name of an agent configured in the allowed
+// agents, which owns the registration, limits and usage of that name.
+func agentFromToken(token string) (config.Agent, error) {
+	var agent config.Agent
+	var claims auth.Claims
+	var keyID string
+
+	header, _, err := jwt.NewParser().ParseUnverified(token, &auth.Claims{})
+	if err != nil {
+		return agent, err
+	}
+	kid, _ := header.Header["kid"].(string)
+
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"HS256", "EdDSA"}), jwt.WithExpirationRequired())
+	err = fmt.Errorf("no jwt key for kid %q and alg %s", kid, header.Method.Alg())
+	for _, key := range config.AGENTS.JWTKeys {
+		if (kid != "" && kid != key.ID) || key.Algorithm != header.Method.Alg() || key.Key == nil {
+			continue
+		}
+		claims = auth.Claims{}
+		_, err = parser.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+			return key.Key, nil
+		})
+		// a token failing other checks than its signature fails with
+		// every key
+		if err == nil || !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			keyID = key.ID
+			break
+		}
+	}
+	if err != nil {
+		return agent, err
+	}
+
+	if claims.Name == "" {
+		return agent, fmt.Errorf("missing name claim")
+	}
+	if configured(claims.Name) {
+		return agent, fmt.Errorf("name claim %s is the name of a configured agent", claims.Name)
+	}
+
+	agent = config.Agent{
+		Name:                claims.Name,
+		ApprovedCNs:         claims.ApprovedCNs,
+		Groups:              claims.Groups,
+		AllowedDestinations: claims.AllowedDestinations,
+		KeyID:               keyID,
+		Expires:             claims.ExpiresAt.Time,
+	}
+	if len(agent.ApprovedCNs) == 0 {
+		agent.ApprovedCNs = []string{claims.Name}
+	}
+	return agent, nil
+}
+
+// tokenKeyID returns the kid of token if it names a configured JWT key, the
+// token is not verified. It is empty otherwise, such tokens are verified
+// against every key of their alg.
+func tokenKeyID(token string) string {
+	header, _, err := jwt.NewParser().ParseUnverified(token, &auth.Claims{})
+	if err != nil {
+		return ""
+	}
+	if kid, _ := header.Header["kid"].(string); jwtKeyExists(kid) {
+		return kid
+	}
+	return ""
+}
+
+// configured reports whether name is the name of an agent in the allowed
+// agents config.
+func configured(name string) bool {
+	for _, agent := range config.AGENTS.Agents {
+		if agent.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtKeyExists reports whether the JWT key with the given ID is configured.
+func jwtKeyExists(id string) bool {
+	for _, key := range config.AGENTS.JWTKeys {
+		if key.ID == id {
+			return true
+		}
+	}
+	return false
+}
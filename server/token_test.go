@@ -0,0 +1,117 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easzlab/ezvpn/auth"
+	"github.com/easzlab/ezvpn/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signToken signs claims for name with the HS256 secret, naming kid in the
+// header when it is not empty.
+func signToken(t *testing.T, secret, kid string, claims auth.Claims) string {
+	t.Helper()
+	if claims.ExpiresAt == nil {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestAgentFromToken(t *testing.T) {
+	saved := config.AGENTS
+	defer func() { config.AGENTS = saved }()
+
+	oldSecret := strings.Repeat("o", config.JWTSecretMinSize)
+	newSecret := strings.Repeat("n", config.JWTSecretMinSize)
+	config.AGENTS = config.AllowedAgents{
+		Agents: []config.Agent{{Name: "test-001"}},
+		JWTKeys: []config.JWTKey{
+			{ID: "new", Algorithm: "HS256", Key: []byte(newSecret)},
+			{ID: "old", Algorithm: "HS256", Key: []byte(oldSecret)},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		wantID string
+	}{
+		{"kid of the first key", signToken(t, newSecret, "new", auth.Claims{Name: "laptop-01"}), "new"},
+		{"kid of the second key", signToken(t, oldSecret, "old", auth.Claims{Name: "laptop-01"}), "old"},
+		{"no kid, first key", signToken(t, newSecret, "", auth.Claims{Name: "laptop-01"}), "new"},
+		{"no kid, second key", signToken(t, oldSecret, "", auth.Claims{Name: "laptop-01"}), "old"},
+		{"kid of another key", signToken(t, oldSecret, "new", auth.Claims{Name: "laptop-01"}), ""},
+		{"unknown kid", signToken(t, oldSecret, "gone", auth.Claims{Name: "laptop-01"}), ""},
+		{"unknown key", signToken(t, strings.Repeat("x", config.JWTSecretMinSize), "", auth.Claims{Name: "laptop-01"}), ""},
+		{"configured agent", signToken(t, newSecret, "new", auth.Claims{Name: "test-001"}), ""},
+		{"no name", signToken(t, newSecret, "new", auth.Claims{}), ""},
+		{"expired", signToken(t, newSecret, "", auth.Claims{Name: "laptop-01", RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		}}), ""},
+	}
+
+	for _, tt := range tests {
+		agent, err := agentFromToken(tt.token)
+		if tt.wantID == "" {
+			if err == nil {
+				t.Errorf("%s: agentFromToken succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: agentFromToken: %v", tt.name, err)
+			continue
+		}
+		if agent.Name != "laptop-01" || agent.KeyID != tt.wantID {
+			t.Errorf("%s: agentFromToken = %s signed by %q, want laptop-01 signed by %q", tt.name, agent.Name, agent.KeyID, tt.wantID)
+		}
+	}
+}
+
+func TestAllowedDestinations(t *testing.T) {
+	saved := config.AGENTS
+	defer func() { config.AGENTS = saved }()
+
+	config.AGENTS = config.AllowedAgents{
+		Groups: []config.Group{
+			{Name: "ops", AllowedDestinations: []string{"10.0.0.0/8"}},
+			{Name: "web", AllowedDestinations: []string{"*.corp.example:443"}},
+		},
+	}
+
+	tests := []struct {
+		agent config.Agent
+		want  []string
+	}{
+		{config.Agent{}, nil},
+		{config.Agent{AllowedDestinations: []string{"db:5432"}}, []string{"db:5432"}},
+		{config.Agent{Groups: []string{"ops"}}, []string{"10.0.0.0/8"}},
+		{config.Agent{Groups: []string{"unknown"}}, nil},
+		{config.Agent{AllowedDestinations: []string{"db:5432"}, Groups: []string{"web", "ops"}}, []string{"db:5432", "10.0.0.0/8", "*.corp.example:443"}},
+	}
+
+	for _, tt := range tests {
+		if got := allowedDestinations(tt.agent); !slices.Equal(got, tt.want) {
+			t.Errorf("allowedDestinations(%v) = %v, want %v", tt.agent.Groups, got, tt.want)
+		}
+	}
+
+	// the destinations of the agent are not changed
+	agent := config.Agent{AllowedDestinations: make([]string, 1, 4), Groups: []string{"ops"}}
+	allowedDestinations(agent)
+	if got := agent.AllowedDestinations[:2]; got[1] != "" {
+		t.Errorf("allowedDestinations appended to the destinations of the agent: %v", got)
+	}
+}
@@ -4,23 +4,25 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 )
 
 func (s *Server) HandleAuth(conn net.Conn) error {
-	cli := conn.RemoteAddr().String()
+	return s.handleAuth(conn, connLogger(conn))
+}
 
+func (s *Server) handleAuth(conn net.Conn, log *slog.Logger) error {
 	// auth-check
 	reply, err := authReply(conn)
 	if err != nil {
-		log.Printf("auth failed from %s, error: %s", cli, err.Error())
+		log.Warn("auth failed", "error", err)
 		return err
 	}
 
 	if n, e := conn.Write([]byte{0x05, reply}); e != nil || n != 2 {
 		senderr := fmt.Errorf("failed to send method selection reply: %v", e)
-		log.Printf("auth failed from %s, error: %s", cli, senderr.Error())
+		log.Warn("auth failed", "error", senderr)
 		return senderr
 	}
 
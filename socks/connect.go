@@ -4,38 +4,47 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 
 	"github.com/easzlab/ezvpn/config"
 )
 
 // CMD CONNECT
-func (s *Server) handleConnect(ctx context.Context, conn net.Conn, req *Request) error {
-	cli := conn.RemoteAddr().String()
+func (s *Server) handleConnect(ctx context.Context, conn net.Conn, req *Request, log *slog.Logger) error {
+	log = log.With("dest", req.DestAddr.String())
 
 	// Try to connect the destination
 	target, err := net.DialTimeout("tcp", req.DestAddr.Address(), config.NetDialTimeout)
 	if err != nil {
-		SendReply(conn, hostUnreachable, nil)
+		req.Reply = hostUnreachable
+		SendReply(conn, req.Reply, nil)
 		errcon := fmt.Errorf("connect to target failed: %v", err)
-		log.Printf("target unreachable, error: %s, client: %s, target: %s", errcon.Error(), cli, req.DestAddr.String())
+		log.Info("target unreachable", "error", err)
 		return errcon
 	}
 	defer target.Close()
 
+	// the IP dialed, which is resolved here unless a rule did it already
+	if remote, ok := target.RemoteAddr().(*net.TCPAddr); ok && len(req.DestAddr.IP) == 0 {
+		req.DestAddr.IP = remote.IP
+	}
+
 	// Send success
 	local, ok := target.LocalAddr().(*net.TCPAddr)
 	if !ok {
 		msg := fmt.Sprintf("expect *net.TCPAddr, not %t", target.LocalAddr())
-		log.Printf("unknown type, error: %s, client: %s, target: %s", msg, cli, req.DestAddr.String())
+		log.Warn("unknown local address type", "error", msg)
 	}
 	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := SendReply(conn, successReply, &bind); err != nil {
-		log.Printf("failed to send reply, error: %s, client: %s, target: %s", err.Error(), cli, req.DestAddr.String())
+	req.Reply = successReply
+	if err := SendReply(conn, req.Reply, &bind); err != nil {
+		log.Warn("failed to send reply", "error", err)
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
+	log.Debug("connected", "ip", req.DestAddr.IP)
+
 	// Start proxying
 	errCh := make(chan error, 2)
 	go proxy(target, conn, errCh)
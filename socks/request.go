@@ -3,7 +3,6 @@ package socks
 import (
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"strconv"
 )
@@ -17,6 +16,9 @@ type AddrSpec struct {
 }
 
 func (a *AddrSpec) String() string {
+	if a.FQDN != "" && len(a.IP) == 0 {
+		return fmt.Sprintf("%s:%d", a.FQDN, a.Port)
+	}
 	if a.FQDN != "" {
 		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
 	}
@@ -42,6 +44,8 @@ type Request struct {
 	RemoteAddr *AddrSpec
 	// AddrSpec of the desired destination
 	DestAddr *AddrSpec
+	// Reply is the REP code sent to the client
+	Reply uint8
 }
 
 func (r *Request) ParseRequest(conn net.Conn) error {
@@ -59,12 +63,15 @@ func (r *Request) ParseRequest(conn net.Conn) error {
 	if err != nil {
 		return err
 	}
-	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
 
 	r.Version = 0x05
 	r.Command = header[1]
 	r.DestAddr = dest
-	r.RemoteAddr = &AddrSpec{IP: remote.IP, Port: remote.Port}
+	r.RemoteAddr = &AddrSpec{}
+	// the connection is not a TCP one when it is served in-process
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		r.RemoteAddr = &AddrSpec{IP: remote.IP, Port: remote.Port}
+	}
 
 	return nil
 }
@@ -150,9 +157,7 @@ func SendReply(w io.Writer, rep uint8, addr *AddrSpec) error {
 		addrPort = uint16(addr.Port)
 
 	default:
-		err := fmt.Errorf("failed to format address: %v", addr)
-		log.Printf("failed to send reply, error: %s, client: , target: ", err.Error())
-		return err
+		return fmt.Errorf("failed to format address: %v", addr)
 	}
 
 	// Format the message
@@ -167,8 +172,5 @@ func SendReply(w io.Writer, rep uint8, addr *AddrSpec) error {
 
 	// Send the message
 	_, err := w.Write(reply)
-	if err != nil {
-		log.Printf("failed to send reply, error: %s, client: , target: ", err.Error())
-	}
 	return err
 }
@@ -0,0 +1,88 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Rule decides whether a request is permitted. It may resolve the FQDN of the
+// destination, in which case the resolved IP is the one dialed.
+type Rule func(req *Request) bool
+
+// destination is a parsed destination pattern.
+type destination struct {
+	host string     // hostname pattern, with `*` wildcards
+	cidr *net.IPNet // or network
+	port string     // port, `*` or empty for any port
+}
+
+// AllowDestinations returns a Rule permitting only the given destinations.
+// A pattern is a host or network with an optional port, for example
+// `*.corp.example.com`, `db.internal:5432`, `10.0.0.0/8`, `10.0.0.0/8:443` or
+// `[2001:db8::/32]:*`.
+func AllowDestinations(patterns []string) Rule {
+	var dests []destination
+	for _, p := range patterns {
+		dests = append(dests, parseDestination(p))
+	}
+
+	return func(req *Request) bool {
+		port := strconv.Itoa(req.DestAddr.Port)
+
+		for _, d := range dests {
+			if d.port != "" && d.port != "*" && d.port != port {
+				continue
+			}
+			if d.host != "" && req.DestAddr.FQDN != "" {
+				if ok, _ := path.Match(d.host, strings.ToLower(req.DestAddr.FQDN)); ok {
+					return true
+				}
+			}
+			if d.cidr != nil && resolve(req.DestAddr) && d.cidr.Contains(req.DestAddr.IP) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// parseDestination parses a destination pattern.
+func parseDestination(p string) destination {
+	var d destination
+
+	host := p
+	if h, port, err := net.SplitHostPort(p); err == nil {
+		host, d.port = h, port
+	}
+
+	if _, cidr, err := net.ParseCIDR(host); err == nil {
+		d.cidr = cidr
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		d.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		d.host = strings.ToLower(host)
+	}
+	return d
+}
+
+// resolve resolves the FQDN of addr, so that the IP checked by a rule is the
+// same one dialed afterwards.
+func resolve(addr *AddrSpec) bool {
+	if addr.IP != nil {
+		return true
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", addr.FQDN)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	addr.IP = ips[0]
+	return true
+}
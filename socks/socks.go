@@ -3,10 +3,21 @@ package socks
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
+
+	"github.com/easzlab/ezvpn/logging"
 )
 
+// logger is the logger of the socks component.
+var logger = logging.Component(logging.Socks)
+
+// connLogger returns the logger for a client connection.
+func connLogger(conn net.Conn) *slog.Logger {
+	return logger.With("remote", conn.RemoteAddr().String())
+}
+
 const (
 	socks5Version = uint8(0x05)
 	// Authentication methods
@@ -22,14 +33,39 @@ const (
 	ipv6Address = uint8(0x04)
 	// Replies REP
 	successReply         = uint8(0x00)
+	generalFailure       = uint8(0x01)
 	ruleBlocked          = uint8(0x02)
 	hostUnreachable      = uint8(0x04)
 	commandNotSupported  = uint8(0x7)
 	addrTypeNotSupported = uint8(0x08)
 )
 
+// replyTexts are the names of the REP codes.
+var replyTexts = map[uint8]string{
+	successReply:         "succeeded",
+	generalFailure:       "general failure",
+	ruleBlocked:          "not allowed by ruleset",
+	hostUnreachable:      "host unreachable",
+	commandNotSupported:  "command not supported",
+	addrTypeNotSupported: "address type not supported",
+}
+
+// ReplyText returns the name of a REP code.
+func ReplyText(rep uint8) string {
+	if text, ok := replyTexts[rep]; ok {
+		return text
+	}
+	return fmt.Sprintf("reply %d", rep)
+}
+
 type Server struct {
 	ListenAddr string
+	// Rule, when set, is checked for every request of the listener.
+	Rule Rule
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
 }
 
 func (s *Server) Run() error {
@@ -37,11 +73,30 @@ func (s *Server) Run() error {
 	if err != nil {
 		return err
 	}
-	log.Println("socks server running on: ", s.ListenAddr)
+	return s.Serve(l)
+}
+
+// Serve accepts client connections on l until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+	logger.Info("socks server is running", "address", l.Addr().String())
 
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
 			return err
 		}
 		// A goroutine for each client connection
@@ -49,27 +104,82 @@ func (s *Server) Run() error {
 	}
 }
 
+// Close stops accepting client connections, the connections being served
+// are not interrupted.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
 func (s *Server) SocksService(conn net.Conn) error {
+	_, err := s.ServeConn(conn, s.Rule, nil)
+	return err
+}
+
+// ServeConn serves a single client connection, requests are checked against
+// rule unless it is nil. The request is returned along with the reply sent to
+// the client, it is nil when the handshake failed. The connection is logged
+// to log, or to the socks logger when it is nil.
+func (s *Server) ServeConn(conn net.Conn, rule Rule, log *slog.Logger) (*Request, error) {
 	defer conn.Close()
 
+	if log == nil {
+		log = connLogger(conn)
+	}
+
 	// Handle Authenticate handshake
+	if err := s.handleAuth(conn, log); err != nil {
+		return nil, err
+	}
+
+	// Handle client requests
+	return s.handleRequest(conn, rule, log)
+}
+
+// Refuse completes the handshake with a client and fails its request with a
+// general failure reply, for a request that cannot be served at all.
+func (s *Server) Refuse(conn net.Conn) error {
+	defer conn.Close()
+
 	if err := s.HandleAuth(conn); err != nil {
 		return err
 	}
 
-	// Handle client requests
-	return s.HandleRequest(conn)
+	r := &Request{}
+	if err := r.ParseRequest(conn); err != nil {
+		SendReply(conn, addrTypeNotSupported, nil)
+		return err
+	}
+	return SendReply(conn, generalFailure, nil)
 }
 
 func (s *Server) HandleRequest(conn net.Conn) error {
+	_, err := s.handleRequest(conn, s.Rule, connLogger(conn))
+	return err
+}
+
+func (s *Server) handleRequest(conn net.Conn, rule Rule, log *slog.Logger) (*Request, error) {
 	// Parse requests
 	r := &Request{}
-	cli := conn.RemoteAddr().String()
 
 	if err := r.ParseRequest(conn); err != nil {
-		log.Printf("failed to parse request, error: %s, client: %s, target: %s", err.Error(), cli, "")
-		SendReply(conn, addrTypeNotSupported, nil)
-		return err
+		log.Warn("failed to parse request", "error", err)
+		r.Reply = addrTypeNotSupported
+		SendReply(conn, r.Reply, nil)
+		return r, err
+	}
+
+	if rule != nil && !rule(r) {
+		r.Reply = ruleBlocked
+		SendReply(conn, r.Reply, nil)
+		log.Info("blocked by rule", "dest", r.DestAddr.String())
+		return r, fmt.Errorf("destination not allowed: %s", r.DestAddr.String())
 	}
 
 	ctx := context.Background()
@@ -77,10 +187,11 @@ func (s *Server) HandleRequest(conn net.Conn) error {
 	// Switch on the command, only CONNECT command supported
 	switch r.Command {
 	case connectCommand:
-		return s.handleConnect(ctx, conn, r)
+		return r, s.handleConnect(ctx, conn, r, log)
 	default:
-		SendReply(conn, commandNotSupported, nil)
-		log.Printf("unsupported command, error: , client: %s, target: %s", cli, r.DestAddr.String())
-		return fmt.Errorf("unsupported command: %v", r.Command)
+		r.Reply = commandNotSupported
+		SendReply(conn, r.Reply, nil)
+		log.Info("unsupported command", "command", r.Command, "dest", r.DestAddr.String())
+		return r, fmt.Errorf("unsupported command: %v", r.Command)
 	}
 }
@@ -0,0 +1,186 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/hashicorp/yamux"
+	"golang.org/x/time/rate"
+)
+
+// Mux carries the control channel and the sessions of an agent as yamux
+// streams of a single TLS connection, without the HTTP upgrade and the
+// websocket framing. Sessions are not compressed.
+type Mux struct {
+	// Address is the host:port of the mux listener of the server.
+	Address string
+	// TLSConfig returns the TLS config of a new connection, TLS is not used
+	// when it is nil.
+	TLSConfig func() *tls.Config
+}
+
+// muxConfig returns the yamux config of both sides.
+func muxConfig() *yamux.Config {
+	c := yamux.DefaultConfig()
+	c.MaxStreamWindowSize = config.MuxWindowSize
+	// keepalives are sent by the agent along with the control channel
+	c.EnableKeepAlive = false
+	c.LogOutput = nil
+	c.Logger = slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
+	return c
+}
+
+func (t *Mux) Dial(ctx context.Context, header http.Header) (ClientConn, error) {
+	dialer := &net.Dialer{Timeout: config.WsHandshakeTimeout}
+	var conn net.Conn
+	var err error
+	if t.TLSConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: t.TLSConfig()}).DialContext(ctx, "tcp", t.Address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", t.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := yamux.Client(conn, muxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, _, err := openStream(s, "/register", header)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &muxClientConn{
+		streamClientConn: newStreamClientConn(s, r, muxSession{session}),
+		session:          session,
+	}, nil
+}
+
+// muxSession is the yamux session of an agent.
+type muxSession struct {
+	*yamux.Session
+}
+
+func (m muxSession) openStream(ctx context.Context) (rawStream, error) {
+	return m.OpenStream()
+}
+
+func (m muxSession) close() error {
+	return m.Close()
+}
+
+// muxClientConn is the control channel of an agent over a yamux session.
+type muxClientConn struct {
+	*streamClientConn
+	session *yamux.Session
+}
+
+// Keepalive pings the server every interval, until the control channel is
+// gone.
+func (c *muxClientConn) Keepalive(interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return nil
+		case <-c.session.CloseChan():
+			return nil
+		}
+
+		rtt := make(chan error, 1)
+		go func() {
+			_, err := c.session.Ping()
+			rtt <- err
+		}()
+		select {
+		case err := <-rtt:
+			if err != nil {
+				return err
+			}
+		case <-ticker.C:
+			c.session.Close()
+			return errors.New("no pong from the server")
+		}
+	}
+}
+
+// ServeMux accepts the yamux sessions of agents on l, and passes the requests
+// opening their streams to handle. TLS connections are handshaked before.
+func ServeMux(l net.Listener, handle func(*Request)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveMuxConn(conn, handle)
+	}
+}
+
+// serveMuxConn serves the yamux session of conn.
+func serveMuxConn(conn net.Conn, handle func(*Request)) {
+	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	var state *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), config.WsHandshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			logger.Info("TLS handshake failed", "remote", remoteIP, "error", err)
+			conn.Close()
+			return
+		}
+		cs := tlsConn.ConnectionState()
+		state = &cs
+	}
+
+	session, err := yamux.Server(conn, muxConfig())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer session.Close()
+
+	// streams are capped, and opened at a limited rate as the credential each
+	// of them carries is verified
+	opens := rate.NewLimiter(config.MuxStreamRate, config.MuxStreamBurst)
+	for {
+		s, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		switch {
+		case session.NumStreams() > config.MuxMaxStreams:
+			go refuseStream(s, remoteIP, "too many streams")
+		case !opens.Allow():
+			go refuseStream(s, remoteIP, "too many new streams")
+		default:
+			go serveStream(s, state, muxCarrier{session}, remoteIP, handle)
+		}
+	}
+}
+
+// muxCarrier closes a yamux session, which can not tell the peer why.
+type muxCarrier struct {
+	session *yamux.Session
+}
+
+func (c muxCarrier) Close() error                   { return c.session.Close() }
+func (c muxCarrier) CloseWithReason(_ string) error { return c.session.Close() }
@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/hashicorp/yamux"
+)
+
+// openSession opens a session over a new stream of the yamux session, which
+// is left open whether the server accepts it or not.
+func openSession(session *yamux.Session) error {
+	s, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	_, _, err = openStream(s, "/session", nil)
+	return err
+}
+
+// refusedFor returns the reason err tells a stream was refused with 429 for.
+func refusedFor(err error) string {
+	var reject *RejectError
+	if errors.As(err, &reject) && reject.Status == http.StatusTooManyRequests {
+		return reject.Reason
+	}
+	return ""
+}
+
+func TestMuxStreamLimits(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	go serveMuxConn(serverConn, func(req *Request) {
+		// the sessions are kept open
+		req.AcceptStream("session", false)
+	})
+	session, err := yamux.Client(clientConn, muxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	limited := 0
+	for i := 1; i <= config.MuxMaxStreams; i++ {
+		err := openSession(session)
+		if err == nil {
+			continue
+		}
+		if i <= config.MuxStreamBurst {
+			t.Fatalf("stream %d of the burst refused: %v", i, err)
+		}
+		if reason := refusedFor(err); reason != "too many new streams" {
+			t.Fatalf("stream %d refused with %v, want too many new streams", i, err)
+		}
+		limited++
+	}
+	if limited == 0 {
+		t.Fatalf("%d streams opened at once, none refused by the rate limit", config.MuxMaxStreams)
+	}
+
+	// the streams refused but still open count towards the cap
+	if err := openSession(session); refusedFor(err) != "too many streams" {
+		t.Fatalf("stream past the cap opened with %v, want too many streams", err)
+	}
+}
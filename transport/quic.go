@@ -0,0 +1,451 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/time/rate"
+)
+
+// QUIC carries the control channel and the sessions of an agent as streams
+// of a single QUIC connection. Sessions do not block each other on packet
+// loss, and the connection migrates when the agent changes networks.
+// Sessions are not compressed.
+type QUIC struct {
+	// Address is the host:port of the QUIC listener of the server.
+	Address string
+	// TLSConfig returns the TLS config of a new connection, it is required.
+	TLSConfig func() *tls.Config
+}
+
+// Application error codes closing QUIC connections.
+const (
+	quicClosed       = quic.ApplicationErrorCode(0)
+	quicClosedReason = quic.ApplicationErrorCode(1)
+)
+
+// quicConfig returns the QUIC config of both sides.
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: config.WsHandshakeTimeout,
+		MaxIdleTimeout:       config.QUICMaxIdleTimeout,
+		KeepAlivePeriod:      config.WsKeepliveInterval,
+		MaxIncomingStreams:   config.QUICMaxStreams,
+	}
+}
+
+// quicError translates the errors of QUIC streams closed by the peer.
+func quicError(err error) error {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote {
+		if appErr.ErrorCode == quicClosed {
+			return ErrClosed
+		}
+		return &CloseError{Reason: appErr.ErrorMessage}
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) && streamErr.Remote {
+		return ErrClosed
+	}
+	return err
+}
+
+// quicStream is a QUIC stream, closed in both directions at once.
+type quicStream struct {
+	quic.Stream
+}
+
+func (s *quicStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	return n, quicError(err)
+}
+
+func (s *quicStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	return n, quicError(err)
+}
+
+// Close sends what was written, and discards what the peer still sends.
+func (s *quicStream) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// closeQUIC closes conn, telling the peer why unless reason is empty.
+func closeQUIC(conn quic.Connection, reason string) error {
+	if reason == "" {
+		return conn.CloseWithError(quicClosed, "")
+	}
+	return conn.CloseWithError(quicClosedReason, reason)
+}
+
+// quicCarrier closes a QUIC connection of an agent.
+type quicCarrier struct {
+	conn quic.Connection
+}
+
+func (c quicCarrier) Close() error                        { return closeQUIC(c.conn, "") }
+func (c quicCarrier) CloseWithReason(reason string) error { return closeQUIC(c.conn, reason) }
+
+func (t *QUIC) Dial(ctx context.Context, header http.Header) (ClientConn, error) {
+	if t.TLSConfig == nil {
+		return nil, errors.New("the QUIC transport requires TLS")
+	}
+	addr, err := net.ResolveUDPAddr("udp", t.Address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := t.TLSConfig()
+	tlsConfig.NextProtos = []string{config.QUICProtocol}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(t.Address)
+	}
+
+	tr, err := newQUICTransport()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tr.Dial(ctx, addr, tlsConfig, quicConfig())
+	if err != nil {
+		closeTransport(tr)
+		return nil, err
+	}
+
+	c := &quicClientConn{conn: conn, addr: addr, transports: []*quic.Transport{tr}}
+	go c.closeTransports()
+
+	s, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(quicClosed, "")
+		return nil, err
+	}
+	r, _, err := openStream(&quicStream{s}, "/register", header)
+	if err != nil {
+		conn.CloseWithError(quicClosed, "")
+		return nil, err
+	}
+	c.streamClientConn = newStreamClientConn(&quicStream{s}, r, c)
+	return c, nil
+}
+
+// newQUICTransport returns a QUIC transport on a new UDP socket.
+func newQUICTransport() (*quic.Transport, error) {
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &quic.Transport{Conn: &quicSocket{PacketConn: udp, udp: udp, done: make(chan struct{})}}, nil
+}
+
+// closeTransport closes tr along with its UDP socket.
+func closeTransport(tr *quic.Transport) {
+	socket := tr.Conn.(*quicSocket)
+	close(socket.done)
+	tr.Close()
+	socket.udp.Close()
+}
+
+// quicSocket is the UDP socket of a path of a QUIC connection. Closing a
+// transport closes every connection which used it, so the socket of a path
+// the connection moved away from is retired instead: it is closed, and its
+// transport reads nothing until it is closed along with the connection.
+// Only net.PacketConn and the buffer sizes are exposed, quic-go reads the
+// socket through them.
+type quicSocket struct {
+	net.PacketConn
+	udp     *net.UDPConn
+	retired atomic.Bool
+	// done is closed once the transport is closed.
+	done chan struct{}
+}
+
+// retire closes the socket, what is still written to it is dropped.
+func (s *quicSocket) retire() {
+	s.retired.Store(true)
+	s.udp.Close()
+}
+
+func (s *quicSocket) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := s.PacketConn.ReadFrom(p)
+	if err != nil && s.retired.Load() {
+		<-s.done
+	}
+	return n, addr, err
+}
+
+func (s *quicSocket) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if s.retired.Load() {
+		return len(p), nil
+	}
+	return s.PacketConn.WriteTo(p, addr)
+}
+
+func (s *quicSocket) SetReadBuffer(bytes int) error  { return s.udp.SetReadBuffer(bytes) }
+func (s *quicSocket) SetWriteBuffer(bytes int) error { return s.udp.SetWriteBuffer(bytes) }
+
+func (s *quicSocket) SyscallConn() (syscall.RawConn, error) { return s.udp.SyscallConn() }
+
+// quicClientConn is the control channel of an agent over a QUIC connection.
+type quicClientConn struct {
+	*streamClientConn
+	conn quic.Connection
+	addr *net.UDPAddr
+
+	// transports are those of the paths the connection used, they are closed
+	// along with the connection. path is the current one, nil on the path
+	// the connection was dialed on.
+	mu         sync.Mutex
+	transports []*quic.Transport
+	path       *quic.Path
+}
+
+func (c *quicClientConn) openStream(ctx context.Context) (rawStream, error) {
+	s, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{s}, nil
+}
+
+func (c *quicClientConn) close() error {
+	return closeQUIC(c.conn, "")
+}
+
+// closeTransports closes the transports once the connection is closed.
+func (c *quicClientConn) closeTransports() {
+	<-c.conn.Context().Done()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tr := range c.transports {
+		closeTransport(tr)
+	}
+}
+
+// Keepalive leaves the pings to QUIC, which closes the connection once the
+// server stopped responding for config.QUICMaxIdleTimeout. Meanwhile, the
+// connection is migrated whenever the local address to the server changes.
+func (c *quicClientConn) Keepalive(interval time.Duration) error {
+	ticker := time.NewTicker(config.NetworkCheckInterval)
+	defer ticker.Stop()
+
+	local := localIP(c.addr)
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return nil
+		case <-c.conn.Context().Done():
+			return context.Cause(c.conn.Context())
+		}
+
+		ip := localIP(c.addr)
+		if ip == nil || ip.Equal(local) {
+			continue
+		}
+		logger.Info("network changed, migrating the connection", "from", local.String(), "to", ip.String())
+		if err := c.migrate(); err != nil {
+			// quic-go keeps a connection ID of the server per path, the
+			// connection runs out of them after a few migrations; the agent
+			// connects again instead
+			logger.Warn("connection migration failed, reconnecting", "error", err)
+			return fmt.Errorf("connection migration failed: %w", err)
+		}
+		local = ip
+	}
+}
+
+// migrate moves the connection to a path from a new UDP socket, once the
+// server validated it.
+func (c *quicClientConn) migrate() error {
+	tr, err := newQUICTransport()
+	if err != nil {
+		return err
+	}
+	path, err := c.conn.AddPath(tr)
+	if err != nil {
+		closeTransport(tr)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.conn.Context(), config.WsHandshakeTimeout)
+	defer cancel()
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		closeTransport(tr)
+		return err
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		closeTransport(tr)
+		return err
+	}
+
+	// the previous path is abandoned, and its socket retired
+	c.mu.Lock()
+	prev, prevPath := c.transports[len(c.transports)-1], c.path
+	c.transports = append(c.transports, tr)
+	c.path = path
+	c.mu.Unlock()
+	if prevPath != nil {
+		prevPath.Close()
+	}
+	prev.Conn.(*quicSocket).retire()
+	return nil
+}
+
+// localIP returns the local address packets to addr are sent from, nil while
+// there is no route to addr.
+func localIP(addr *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// QUICServer serves the agents connecting over QUIC.
+type QUICServer struct {
+	tr *quic.Transport
+	ln *quic.Listener
+
+	mu    sync.Mutex
+	conns map[quic.Connection]struct{}
+}
+
+// ListenQUIC returns the QUIC server of agents on conn, which verifies them
+// as tlsConfig tells. generation, 0 or 1, tells the connections of the server
+// from those of the previous process draining on the same port after an
+// upgrade.
+func ListenQUIC(conn net.PacketConn, tlsConfig *tls.Config, generation uint8) (*QUICServer, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{config.QUICProtocol}
+	if get := tlsConfig.GetConfigForClient; get != nil {
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := get(hello)
+			if c != nil {
+				c.NextProtos = []string{config.QUICProtocol}
+			}
+			return c, err
+		}
+	}
+
+	if err := steerQUIC(conn, generation); err != nil {
+		// packets of draining connections may reach the new process
+		logger.Warn("failed to steer quic packets by generation", "error", err)
+	}
+	tr := &quic.Transport{Conn: conn, ConnectionIDGenerator: quicConnIDs(generation)}
+	ln, err := tr.Listen(tlsConfig, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &QUICServer{tr: tr, ln: ln, conns: map[quic.Connection]struct{}{}}, nil
+}
+
+// quicConnIDs generates the connection IDs of a QUIC server, the lowest bit
+// of their first byte is its generation.
+type quicConnIDs uint8
+
+func (g quicConnIDs) GenerateConnectionID() (quic.ConnectionID, error) {
+	b := make([]byte, config.QUICConnIDLength)
+	if _, err := rand.Read(b); err != nil {
+		return quic.ConnectionID{}, err
+	}
+	b[0] = b[0]&^1 | byte(g)
+	return quic.ConnectionIDFromBytes(b), nil
+}
+
+func (quicConnIDs) ConnectionIDLen() int {
+	return config.QUICConnIDLength
+}
+
+// Serve accepts the connections of agents, and passes the requests opening
+// their streams to handle. It returns once Stop or Close is called.
+func (s *QUICServer) Serve(handle func(*Request)) error {
+	for {
+		conn, err := s.ln.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return net.ErrClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn, handle)
+	}
+}
+
+// serveConn serves the streams of conn until it is closed.
+func (s *QUICServer) serveConn(conn quic.Connection, handle func(*Request)) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	state := conn.ConnectionState().TLS
+	// streams are capped by the QUIC flow control, and opened at a limited
+	// rate as over mux
+	opens := rate.NewLimiter(config.QUICStreamRate, config.QUICStreamBurst)
+	for {
+		st, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		// the address changes as the agent migrates
+		remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !opens.Allow() {
+			go refuseStream(&quicStream{st}, remoteIP, "too many new streams")
+			continue
+		}
+		go serveStream(&quicStream{st}, &state, quicCarrier{conn}, remoteIP, handle)
+	}
+}
+
+// Stop stops accepting connections, the current ones are still served.
+func (s *QUICServer) Stop() error {
+	return s.ln.Close()
+}
+
+// Close closes the connections, telling the agents why, and the packet conn.
+// The agents are given config.WsCloseTimeout to close them first, closing a
+// connection discards what its streams did not deliver yet, e.g. the going
+// away message and the close of the control channel.
+func (s *QUICServer) Close(reason string) error {
+	s.ln.Close()
+
+	s.mu.Lock()
+	conns := make([]quic.Connection, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.WsCloseTimeout)
+	defer cancel()
+	for _, conn := range conns {
+		select {
+		case <-conn.Context().Done():
+		case <-ctx.Done():
+		}
+		closeQUIC(conn, reason)
+	}
+
+	s.tr.Close()
+	return s.tr.Conn.Close()
+}
@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/pki"
+)
+
+// testTLS returns the TLS configs of a server certified for 127.0.0.1 and of
+// a client trusting it.
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	dir := t.TempDir()
+	if err := pki.InitCA(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := pki.IssueServer(dir, []string{"127.0.0.1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, pki.ServerFile), filepath.Join(dir, pki.ServerKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := pki.ReadCertificate(filepath.Join(dir, pki.CAFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, &tls.Config{RootCAs: roots}
+}
+
+func TestQUICStreamRate(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s, err := ListenQUIC(conn, serverTLS, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	go s.Serve(func(req *Request) {
+		// the control channel and the sessions are kept open
+		if req.Route == "/register" {
+			req.AcceptConn()
+		} else {
+			req.AcceptStream("session", false)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := (&QUIC{Address: conn.LocalAddr().String(), TLSConfig: clientTLS.Clone}).Dial(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the control channel is the first stream of the burst
+	for i := 1; i < config.QUICStreamBurst; i++ {
+		if _, err := c.Open(ctx, nil); err != nil {
+			t.Fatalf("session %d of the burst refused: %v", i, err)
+		}
+	}
+	for i := 0; ; i++ {
+		_, err := c.Open(ctx, nil)
+		if err == nil {
+			if i == config.QUICStreamBurst {
+				t.Fatalf("%d more sessions opened at once, none refused by the rate limit", i)
+			}
+			continue
+		}
+		if reason := refusedFor(err); reason != "too many new streams" {
+			t.Fatalf("session refused with %v, want too many new streams", err)
+		}
+		break
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package transport
+
+import "net"
+
+// steerQUIC does nothing, the kernel spreads the packets of QUIC connections
+// over the sockets of an upgraded server on its own.
+func steerQUIC(conn net.PacketConn, generation uint8) error {
+	return nil
+}
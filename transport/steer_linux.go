@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// steerQUIC attaches a program to the SO_REUSEPORT group of conn, which
+// picks the socket of the process a QUIC packet belongs to while an upgraded
+// server drains: packets of new connections go to the socket joined last,
+// those of established connections to the socket of the generation their
+// connection ID is marked with. Once a process is alone, the picked socket
+// does not exist and the kernel falls back to it.
+func steerQUIC(conn net.PacketConn, generation uint8) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("not a socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	prog, err := bpf.Assemble(steerProgram(generation))
+	if err != nil {
+		return err
+	}
+	filter := make([]unix.SockFilter, len(prog))
+	for i, ins := range prog {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	fprog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &fprog)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// steerProgram returns the program steering the QUIC packets of the server of
+// generation to the socket index it returns. The packet starts at the UDP
+// payload, the sockets of a group are numbered in the order they joined.
+func steerProgram(generation uint8) []bpf.Instruction {
+	return []bpf.Instruction{
+		// long header: a new connection
+		bpf.LoadAbsolute{Off: 0, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x80, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		// short header: the first byte of the destination connection ID
+		bpf.LoadAbsolute{Off: 1, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(generation), SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}
+}
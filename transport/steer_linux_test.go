@@ -0,0 +1,61 @@
+package transport
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestSteerProgram(t *testing.T) {
+	// the socket of the process joined last, and the one of the previous
+	// process
+	const current, previous = 1, 0
+
+	tests := []struct {
+		name       string
+		packet     []byte
+		generation uint8
+		want       int
+	}{
+		// new connections go to the current process whatever the generation
+		{"initial", []byte{0xc0, 0, 0, 0, 1, 8, 0x01}, 0, current},
+		{"initial", []byte{0xc0, 0, 0, 0, 1, 8, 0x00}, 1, current},
+		{"handshake", []byte{0xe0, 0, 0, 0, 1, 8, 0x01}, 0, current},
+		// established connections go to the generation of their ID
+		{"short header of generation 0", []byte{0x40, 0xa2, 0x17}, 0, current},
+		{"short header of generation 0", []byte{0x40, 0xa2, 0x17}, 1, previous},
+		{"short header of generation 1", []byte{0x40, 0xa3, 0x17}, 0, previous},
+		{"short header of generation 1", []byte{0x40, 0xa3, 0x17}, 1, current},
+	}
+
+	for _, tt := range tests {
+		vm, err := bpf.NewVM(steerProgram(tt.generation))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := vm.Run(tt.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: program of generation %d picked socket %d, want %d", tt.name, tt.generation, got, tt.want)
+		}
+	}
+
+	// the IDs the server generates are steered back to it
+	for _, generation := range []uint8{0, 1} {
+		vm, err := bpf.NewVM(steerProgram(generation))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 16; i++ {
+			id, err := quicConnIDs(generation).GenerateConnectionID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := vm.Run(append([]byte{0x40}, id.Bytes()...)); got != current {
+				t.Fatalf("ID %s of generation %d steered to socket %d", id, generation, got)
+			}
+		}
+	}
+}
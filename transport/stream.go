@@ -0,0 +1,403 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/easzlab/ezvpn/logging"
+)
+
+// logger is the logger of the transport component.
+var logger = logging.Component(logging.Transport)
+
+// The stream based transports carry the control channel and the sessions as
+// streams of a single connection. A stream is opened by the agent with a
+// streamRequest and answered by the server with a streamResponse, both sent
+// as JSON lines. Sessions then carry the raw data, while the control channel
+// carries frames of a type byte and a 4 bytes big endian length.
+
+// streamRequest opens a stream, Route tells the kind of the stream as the
+// path of the websocket transport does.
+type streamRequest struct {
+	Route  string      `json:"route"`
+	Header http.Header `json:"header"`
+}
+
+// streamResponse answers a streamRequest, the stream is accepted with
+// http.StatusOK.
+type streamResponse struct {
+	Status     int    `json:"status"`
+	SessionID  string `json:"session_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// Frame types of the control channel.
+const (
+	frameMessage = byte(0)
+	frameClose   = byte(1)
+)
+
+// writeLine writes v as a JSON line.
+func writeLine(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// readLine reads a JSON line into v.
+func readLine(r *bufio.Reader, v any) error {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// rawStream is a stream of a multiplexed connection.
+type rawStream interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+}
+
+// multiplexed is the connection of an agent carrying its streams.
+type multiplexed interface {
+	openStream(ctx context.Context) (rawStream, error)
+	close() error
+}
+
+// setDeadline sets the deadline of s, if it supports deadlines.
+func setDeadline(s io.ReadWriteCloser, t time.Time) {
+	if d, ok := s.(interface{ SetDeadline(time.Time) error }); ok {
+		d.SetDeadline(t)
+	}
+}
+
+// openStream sends the request opening s, and returns the response along
+// with the reader to read s with from now on.
+func openStream(s io.ReadWriteCloser, route string, header http.Header) (*bufio.Reader, *streamResponse, error) {
+	setDeadline(s, time.Now().Add(config.WsHandshakeTimeout))
+	defer setDeadline(s, time.Time{})
+
+	if err := writeLine(s, streamRequest{Route: route, Header: header}); err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReaderSize(s, config.HandshakeMaxSize)
+	var resp streamResponse
+	if err := readLine(r, &resp); err != nil {
+		return nil, nil, err
+	}
+	if resp.Status != http.StatusOK {
+		return nil, nil, &RejectError{Status: resp.Status, Reason: resp.Error}
+	}
+	return r, &resp, nil
+}
+
+// serveStream reads the request opening s, which came on a connection with
+// the TLS state and from remoteIP, and passes it to handle.
+func serveStream(s io.ReadWriteCloser, state *tls.ConnectionState, carrier Closer, remoteIP string, handle func(*Request)) {
+	r := bufio.NewReaderSize(s, config.HandshakeMaxSize)
+	setDeadline(s, time.Now().Add(config.WsHandshakeTimeout))
+	var req streamRequest
+	if err := readLine(r, &req); err != nil {
+		logger.Info("failed to read the stream request", "remote", remoteIP, "error", err)
+		s.Close()
+		return
+	}
+	setDeadline(s, time.Time{})
+
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	handle(&Request{
+		Header:    req.Header,
+		TLS:       state,
+		RemoteIP:  remoteIP,
+		Carrier:   carrier,
+		Route:     req.Route,
+		responder: &streamResponder{s: s, r: r},
+	})
+}
+
+// refuseStream answers the request opening s with 429, without reading it.
+func refuseStream(s rawStream, remoteIP, reason string) {
+	logger.Info("stream refused", "remote", remoteIP, "reason", reason)
+	s.SetDeadline(time.Now().Add(config.WsHandshakeTimeout))
+	writeLine(s, streamResponse{Status: http.StatusTooManyRequests, Error: reason, RetryAfter: 1})
+	s.Close()
+}
+
+// streamResponder answers requests with a streamResponse.
+type streamResponder struct {
+	s io.ReadWriteCloser
+	r *bufio.Reader
+}
+
+func (sr *streamResponder) acceptConn() (Conn, error) {
+	if err := writeLine(sr.s, streamResponse{Status: http.StatusOK}); err != nil {
+		sr.s.Close()
+		return nil, err
+	}
+	return &frameConn{s: sr.s, r: sr.r}, nil
+}
+
+// acceptStream accepts a session, compress is ignored: streams are written
+// straight through and never compressed, agents on the mux and QUIC
+// transports refuse to run with compression.
+func (sr *streamResponder) acceptStream(sessionID string, compress bool) (Stream, error) {
+	if err := writeLine(sr.s, streamResponse{Status: http.StatusOK, SessionID: sessionID}); err != nil {
+		sr.s.Close()
+		return nil, err
+	}
+	return &byteStream{s: sr.s, r: sr.r, id: sessionID}, nil
+}
+
+func (sr *streamResponder) reject(status int, retryAfter time.Duration, reason string) error {
+	defer sr.s.Close()
+	return writeLine(sr.s, streamResponse{
+		Status:     status,
+		Error:      reason,
+		RetryAfter: int(math.Ceil(retryAfter.Seconds())),
+	})
+}
+
+// frameConn is a control channel over a stream.
+type frameConn struct {
+	s io.ReadWriteCloser
+	r *bufio.Reader
+
+	// mu serializes the frames written, closing may race with a message.
+	mu sync.Mutex
+}
+
+func (c *frameConn) ReadMessage() ([]byte, error) {
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, ErrClosed
+			}
+			return nil, err
+		}
+
+		size := binary.BigEndian.Uint32(header[1:])
+		if size > config.HandshakeMaxSize {
+			return nil, fmt.Errorf("control frame of %d bytes is too large", size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+
+		switch header[0] {
+		case frameMessage:
+			return data, nil
+		case frameClose:
+			if len(data) == 0 {
+				return nil, ErrClosed
+			}
+			return nil, &CloseError{Reason: string(data)}
+		}
+		// frames of unknown types are skipped
+	}
+}
+
+func (c *frameConn) WriteMessage(data []byte) error {
+	return c.writeFrame(frameMessage, data)
+}
+
+// writeFrame writes a frame of typ carrying data.
+func (c *frameConn) writeFrame(typ byte, data []byte) error {
+	frame := make([]byte, 5+len(data))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	copy(frame[5:], data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.s.Write(frame)
+	return err
+}
+
+func (c *frameConn) Close() error {
+	return c.CloseWithReason("")
+}
+
+func (c *frameConn) CloseWithReason(reason string) error {
+	setDeadline(c.s, time.Now().Add(config.WsCloseTimeout))
+	c.writeFrame(frameClose, []byte(reason))
+	return c.s.Close()
+}
+
+// streamClientConn is the control channel of an agent over a stream of a
+// multiplexed connection, its sessions are streams of the same connection.
+// The connection outlives the control channel until its sessions are closed,
+// as they do with the websocket transport.
+type streamClientConn struct {
+	frameConn
+	m multiplexed
+
+	// done is closed once the control channel is gone.
+	done     chan struct{}
+	doneOnce sync.Once
+	// streams tracks the open sessions.
+	streams sync.WaitGroup
+}
+
+// newStreamClientConn returns the control channel opened as s, read with r,
+// of the connection m.
+func newStreamClientConn(s rawStream, r *bufio.Reader, m multiplexed) *streamClientConn {
+	return &streamClientConn{
+		frameConn: frameConn{s: s, r: r},
+		m:         m,
+		done:      make(chan struct{}),
+	}
+}
+
+// ReadMessage reads the next control message.
+func (c *streamClientConn) ReadMessage() ([]byte, error) {
+	data, err := c.frameConn.ReadMessage()
+	if err != nil {
+		c.doneOnce.Do(func() { close(c.done) })
+	}
+	return data, err
+}
+
+func (c *streamClientConn) Open(ctx context.Context, header http.Header) (Stream, error) {
+	s, err := c.m.openStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the stream is not bound to ctx once opened
+	unhook := context.AfterFunc(ctx, func() { s.Close() })
+	r, resp, err := openStream(s, "/session", header)
+	if !unhook() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	c.streams.Add(1)
+	return &byteStream{s: &trackedStream{rawStream: s, done: c.streams.Done}, r: r, id: resp.SessionID}, nil
+}
+
+func (c *streamClientConn) Close() error {
+	return c.CloseWithReason("")
+}
+
+// CloseWithReason closes the control channel, then the connection once its
+// sessions are closed.
+func (c *streamClientConn) CloseWithReason(reason string) error {
+	c.doneOnce.Do(func() { close(c.done) })
+	err := c.frameConn.CloseWithReason(reason)
+	go func() {
+		c.streams.Wait()
+		c.m.close()
+	}()
+	return err
+}
+
+// trackedStream calls done once closed.
+type trackedStream struct {
+	rawStream
+	done func()
+	once sync.Once
+}
+
+func (s *trackedStream) Close() error {
+	s.once.Do(s.done)
+	return s.rawStream.Close()
+}
+
+// byteStream is a session over a stream, data is sent as is.
+type byteStream struct {
+	s  io.ReadWriteCloser
+	r  *bufio.Reader
+	id string
+
+	// eof is set once the peer closed the stream.
+	eof bool
+}
+
+// NextReader returns the reader of the data of a single read, so that the
+// data is accounted for as it arrives, then ErrClosed once the peer closed.
+func (s *byteStream) NextReader() (io.Reader, error) {
+	if s.eof {
+		return nil, ErrClosed
+	}
+	return &readOnce{s: s}, nil
+}
+
+// readOnce reads a stream once, then returns io.EOF.
+type readOnce struct {
+	s    *byteStream
+	done bool
+}
+
+func (r *readOnce) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	r.done = true
+	n, err := r.s.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		r.s.eof = true
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// NextWriter returns a writer to the stream, messages are not compressed.
+func (s *byteStream) NextWriter(compress bool) (io.WriteCloser, error) {
+	return nopCloser{s.s}, nil
+}
+
+func (s *byteStream) Close() error {
+	return s.s.Close()
+}
+
+// CloseWithReason closes the stream, streams carry no close reason.
+func (s *byteStream) CloseWithReason(reason string) error {
+	return s.s.Close()
+}
+
+func (s *byteStream) SessionID() string {
+	return s.id
+}
+
+func (s *byteStream) Compressed() bool {
+	return false
+}
+
+// Unframed tells that messages are written straight to the stream.
+func (s *byteStream) Unframed() bool {
+	return true
+}
+
+// nopCloser is a writer of a message, written right away.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+// Package transport carries the control channels and the sessions between
+// agents and the server, so that the tunnel logic does not depend on how they
+// are carried.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrClosed is returned by reads once the peer closed normally.
+var ErrClosed = errors.New("closed by the peer")
+
+// CloseError is returned by reads once the peer closed telling why.
+type CloseError struct {
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return "closed by the peer: " + e.Reason
+}
+
+// RejectError is returned to agents whose request was rejected by the server.
+type RejectError struct {
+	Status int
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("refused by the server: %s", e.Reason)
+}
+
+// Closer closes a control channel, a session or the connection carrying them.
+type Closer interface {
+	// Close closes normally, it is ok to call it more than once or after the
+	// peer closed.
+	Close() error
+	// CloseWithReason closes telling the peer why.
+	CloseWithReason(reason string) error
+}
+
+// Conn is the control channel of an agent, carrying control messages.
+type Conn interface {
+	Closer
+	// ReadMessage reads the next control message.
+	ReadMessage() ([]byte, error)
+	// WriteMessage writes a control message, it must not be called
+	// concurrently.
+	WriteMessage(data []byte) error
+}
+
+// ClientConn is the control channel as seen by the agent.
+type ClientConn interface {
+	Conn
+	// Keepalive checks the server every interval, while the control messages
+	// are read, and returns once the server stopped responding or the
+	// connection is closed.
+	Keepalive(interval time.Duration) error
+	// Open opens a session, header carries the credential of the agent.
+	Open(ctx context.Context, header http.Header) (Stream, error)
+}
+
+// Stream is a session, carrying the data of a tunneled connection in
+// messages.
+type Stream interface {
+	Closer
+	// NextReader returns the reader of the next message.
+	NextReader() (io.Reader, error)
+	// NextWriter returns the writer of the next message, which is sent once
+	// closed. compress asks for the message to be compressed, it is ignored
+	// unless Compressed.
+	NextWriter(compress bool) (io.WriteCloser, error)
+	// SessionID is the ID the server assigned to the session.
+	SessionID() string
+	// Compressed tells whether compression was negotiated for the session.
+	Compressed() bool
+}
+
+// Unframed is implemented by streams writing messages straight through to a
+// byte stream, such as the streams of the mux and QUIC transports. Writes are
+// not turned into frames of their own, so coalescing them gains nothing.
+type Unframed interface {
+	Unframed() bool
+}
+
+// Transport connects an agent to the server.
+type Transport interface {
+	// Dial registers the control channel of the agent, header carries its
+	// credential.
+	Dial(ctx context.Context, header http.Header) (ClientConn, error)
+}
+
+// Request is a request of an agent, to register its control channel or to
+// open a session, as received by the server.
+type Request struct {
+	// Header carries the credential of the agent.
+	Header http.Header
+	// TLS is the state of the connection the request came on, it is nil
+	// without TLS.
+	TLS *tls.ConnectionState
+	// RemoteIP is the address of the agent.
+	RemoteIP string
+	// Carrier is the mux session or QUIC connection the request came on,
+	// shared by the other requests of the agent and handshaked once. It is
+	// nil for websockets, each of which is a connection of its own.
+	Carrier Closer
+	// Route names the request in logs, e.g. `/session`.
+	Route string
+
+	responder responder
+}
+
+// responder answers a request the way its transport does.
+type responder interface {
+	acceptConn() (Conn, error)
+	acceptStream(sessionID string, compress bool) (Stream, error)
+	reject(status int, retryAfter time.Duration, reason string) error
+}
+
+// AcceptConn accepts a registration and returns the control channel.
+func (r *Request) AcceptConn() (Conn, error) {
+	return r.responder.acceptConn()
+}
+
+// AcceptStream accepts a session identified by sessionID, and returns it.
+// compress allows compression, if the agent asks for it.
+func (r *Request) AcceptStream(sessionID string, compress bool) (Stream, error) {
+	return r.responder.acceptStream(sessionID, compress)
+}
+
+// Reject rejects the request with the status and reason, the agent is told to
+// retry after retryAfter unless it is 0.
+func (r *Request) Reject(status int, retryAfter time.Duration, reason string) error {
+	return r.responder.reject(status, retryAfter, reason)
+}
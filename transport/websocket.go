@@ -0,0 +1,283 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/easzlab/ezvpn/config"
+	"github.com/gorilla/websocket"
+)
+
+// writeBufferPool is shared by the websocket connections, so that their
+// write buffers are only held while a message is written.
+var writeBufferPool = &sync.Pool{}
+
+// upgrader is the websocket upgrader.
+var upgrader = websocket.Upgrader{
+	WriteBufferSize: config.MaxMessageSize,
+	WriteBufferPool: writeBufferPool,
+}
+
+// compressingUpgrader negotiates permessage-deflate, for the sessions of
+// agents with compression enabled.
+var compressingUpgrader = websocket.Upgrader{
+	WriteBufferSize:   config.MaxMessageSize,
+	WriteBufferPool:   writeBufferPool,
+	EnableCompression: true,
+}
+
+// WebSocket carries the control channel, at /register, and every session,
+// at /session, over a websocket connection of their own.
+type WebSocket struct {
+	// Address is the host:port of the server.
+	Address string
+	// TLSConfig returns the TLS config of a new connection, it is called for
+	// every dial so that rotated certificates are used. TLS is not used when
+	// it is nil.
+	TLSConfig func() *tls.Config
+	// Compression asks the server for compressed sessions.
+	Compression bool
+}
+
+// url returns the URL of path on the server.
+func (t *WebSocket) url(path string) string {
+	if t.TLSConfig != nil {
+		return "wss://" + t.Address + path
+	}
+	return "ws://" + t.Address + path
+}
+
+// dialer returns the websocket dialer of a new connection.
+func (t *WebSocket) dialer(compress bool) *websocket.Dialer {
+	dialer := &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  config.WsHandshakeTimeout,
+		WriteBufferSize:   config.MaxMessageSize,
+		WriteBufferPool:   writeBufferPool,
+		EnableCompression: compress,
+	}
+	if t.TLSConfig != nil {
+		dialer.TLSClientConfig = t.TLSConfig()
+	}
+	return dialer
+}
+
+func (t *WebSocket) Dial(ctx context.Context, header http.Header) (ClientConn, error) {
+	ws, resp, err := t.dialer(false).DialContext(ctx, t.url("/register"), header)
+	if err != nil {
+		return nil, dialError(resp, err)
+	}
+	return &wsClientConn{wsConn: wsConn{ws: ws}, t: t}, nil
+}
+
+// dialError turns a failed handshake into a RejectError.
+func dialError(resp *http.Response, err error) error {
+	if !errors.Is(err, websocket.ErrBadHandshake) || resp == nil {
+		return err
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body); err != nil || body.Error == "" {
+		return &RejectError{Status: resp.StatusCode, Reason: resp.Status}
+	}
+	return &RejectError{Status: resp.StatusCode, Reason: body.Error}
+}
+
+// negotiated returns whether permessage-deflate was negotiated, given the
+// headers of the handshake response, or of the request on a server allowing
+// compression.
+func negotiated(h http.Header) bool {
+	return strings.Contains(h.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+}
+
+// closeError translates the close frame of the peer.
+func closeError(err error) error {
+	var closed *websocket.CloseError
+	if !errors.As(err, &closed) || closed.Code == websocket.CloseAbnormalClosure {
+		return err
+	}
+	if closed.Code == websocket.CloseNormalClosure || closed.Code == websocket.CloseGoingAway {
+		return ErrClosed
+	}
+	return &CloseError{Reason: closed.Text}
+}
+
+// wsConn is a control channel over a websocket, control messages are text
+// messages.
+type wsConn struct {
+	ws *websocket.Conn
+}
+
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	for {
+		typ, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return nil, closeError(err)
+		}
+		if typ == websocket.TextMessage {
+			return data, nil
+		}
+	}
+}
+
+func (c *wsConn) WriteMessage(data []byte) error {
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) Close() error {
+	return c.close(websocket.CloseNormalClosure, "")
+}
+
+func (c *wsConn) CloseWithReason(reason string) error {
+	return c.close(websocket.ClosePolicyViolation, reason)
+}
+
+// close sends a close frame, then closes the connection.
+func (c *wsConn) close(code int, reason string) error {
+	c.ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(config.WsCloseTimeout),
+	)
+	return c.ws.Close()
+}
+
+// wsClientConn is the control channel of an agent over a websocket, its
+// sessions are dialed on their own.
+type wsClientConn struct {
+	wsConn
+	t *WebSocket
+}
+
+// Keepalive pings the server every interval, the pongs are read along with
+// the control messages.
+func (c *wsClientConn) Keepalive(interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// the reads are not blocked by pongs arriving once this returned
+	pong := make(chan bool, 1)
+	c.ws.SetPongHandler(func(_ string) error {
+		select {
+		case pong <- true:
+		default:
+		}
+		return nil
+	})
+
+	for tick := range ticker.C {
+		if err := c.ws.WriteControl(websocket.PingMessage, []byte(""), tick.Add(interval)); err != nil {
+			return err
+		}
+
+		select {
+		case <-pong:
+		case <-ticker.C:
+			return errors.New("no pong from the server")
+		}
+	}
+	return nil
+}
+
+func (c *wsClientConn) Open(ctx context.Context, header http.Header) (Stream, error) {
+	ws, resp, err := c.t.dialer(c.t.Compression).DialContext(ctx, c.t.url("/session"), header)
+	if err != nil {
+		return nil, dialError(resp, err)
+	}
+	return &wsStream{
+		wsConn:     wsConn{ws: ws},
+		id:         resp.Header.Get(config.SessionIDHeader),
+		compressed: negotiated(resp.Header),
+	}, nil
+}
+
+// wsStream is a session over a websocket, data is sent in binary messages.
+type wsStream struct {
+	wsConn
+	id         string
+	compressed bool
+}
+
+func (s *wsStream) NextReader() (io.Reader, error) {
+	_, r, err := s.ws.NextReader()
+	if err != nil {
+		return nil, closeError(err)
+	}
+	return r, nil
+}
+
+func (s *wsStream) NextWriter(compress bool) (io.WriteCloser, error) {
+	s.ws.EnableWriteCompression(compress && s.compressed)
+	return s.ws.NextWriter(websocket.BinaryMessage)
+}
+
+func (s *wsStream) SessionID() string {
+	return s.id
+}
+
+func (s *wsStream) Compressed() bool {
+	return s.compressed
+}
+
+// WebSocketRequest returns the request of an agent to upgrade r to a
+// websocket, remoteIP and route are those of r.
+func WebSocketRequest(w http.ResponseWriter, r *http.Request, remoteIP, route string) *Request {
+	return &Request{
+		Header:    r.Header,
+		TLS:       r.TLS,
+		RemoteIP:  remoteIP,
+		Route:     route,
+		responder: &wsResponder{w: w, r: r},
+	}
+}
+
+// wsResponder answers requests by upgrading them, or with a JSON error.
+type wsResponder struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+func (wr *wsResponder) acceptConn() (Conn, error) {
+	ws, err := upgrader.Upgrade(wr.w, wr.r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{ws: ws}, nil
+}
+
+func (wr *wsResponder) acceptStream(sessionID string, compress bool) (Stream, error) {
+	u := &upgrader
+	if compress {
+		u = &compressingUpgrader
+	}
+	// the session ID is sent to the agent, so that both sides log it
+	ws, err := u.Upgrade(wr.w, wr.r, http.Header{config.SessionIDHeader: {sessionID}})
+	if err != nil {
+		return nil, err
+	}
+	return &wsStream{
+		wsConn:     wsConn{ws: ws},
+		id:         sessionID,
+		compressed: compress && negotiated(wr.r.Header),
+	}, nil
+}
+
+func (wr *wsResponder) reject(status int, retryAfter time.Duration, reason string) error {
+	if retryAfter > 0 {
+		wr.w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	wr.w.Header().Set("Content-Type", "application/json")
+	wr.w.WriteHeader(status)
+	return json.NewEncoder(wr.w).Encode(map[string]string{"error": reason})
+}
@@ -0,0 +1,253 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Counter is the traffic of an agent in bytes, upload is from the agent to
+// its destinations.
+type Counter struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// Total returns the bytes of both directions.
+func (c Counter) Total() int64 {
+	return c.Up + c.Down
+}
+
+// Usage is the traffic of an agent in the current day and month.
+type Usage struct {
+	Agent      string  `json:"agent"`
+	Day        string  `json:"day"`
+	DayBytes   Counter `json:"day_bytes"`
+	Month      string  `json:"month"`
+	MonthBytes Counter `json:"month_bytes"`
+}
+
+// Store keeps the usage of agents in memory and persists it to a JSON file,
+// so that it survives restarts.
+type Store struct {
+	file string
+
+	// flushMu serializes flushes, which share the temporary file.
+	flushMu sync.Mutex
+
+	// version counts the changes, flushed is the version last written.
+	// Nothing is written once frozen, the traffic counted from then on is
+	// also kept in deltas.
+	mu      sync.Mutex
+	usage   map[string]*Usage
+	deltas  map[string]*Usage
+	version uint64
+	flushed uint64
+	frozen  bool
+}
+
+// Open loads the store from file, a missing file is an empty store.
+func Open(file string) (*Store, error) {
+	s := &Store{file: file, usage: map[string]*Usage{}}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Usage
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, u := range list {
+		s.usage[u.Agent] = u
+	}
+	return s, nil
+}
+
+// Add counts traffic of agent.
+func (s *Store) Add(agent string, up, down int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	traffic := Counter{Up: up, Down: down}
+	add(s.current(agent), traffic, traffic)
+	if s.frozen {
+		add(current(s.deltas, agent), traffic, traffic)
+	}
+	s.version++
+}
+
+// Merge adds the usage counted by another process, such as the Deltas of the
+// process this one took over from. Counters of a past day or month are
+// dropped.
+func (s *Store) Merge(list []Usage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range list {
+		var day, month Counter
+		cur := s.current(u.Agent)
+		if u.Day == cur.Day {
+			day = u.DayBytes
+		}
+		if u.Month == cur.Month {
+			month = u.MonthBytes
+		}
+		add(cur, day, month)
+		if s.frozen {
+			add(current(s.deltas, u.Agent), day, month)
+		}
+	}
+	s.version++
+}
+
+// add adds the traffic of the day and of the month to u.
+func add(u *Usage, day, month Counter) {
+	u.DayBytes.Up += day.Up
+	u.DayBytes.Down += day.Down
+	u.MonthBytes.Up += month.Up
+	u.MonthBytes.Down += month.Down
+}
+
+// Deltas returns the usage counted since the store was frozen, sorted by
+// agent name, which the process taking over the file has not loaded. It is
+// empty unless frozen.
+func (s *Store) Deltas() []Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []Usage{}
+	for _, u := range s.deltas {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Agent < list[j].Agent })
+	return list
+}
+
+// Get returns the usage of agent in the current day and month.
+func (s *Store) Get(agent string) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.current(agent)
+}
+
+// List returns the usage of all agents in the current day and month, sorted
+// by agent name.
+func (s *Store) List() []Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []Usage{}
+	for agent := range s.usage {
+		list = append(list, *s.current(agent))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Agent < list[j].Agent })
+	return list
+}
+
+// Flush writes the store to its file if it changed since the last successful
+// flush. After a failed flush, the next one writes the store again. It does
+// nothing while the store is frozen.
+func (s *Store) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	return s.flush(false)
+}
+
+// Freeze flushes the store a last time and stops writing its file, which
+// another process takes over. Traffic is still counted in memory, and apart
+// in Deltas to be passed to that process.
+func (s *Store) Freeze() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	s.frozen = true
+	s.deltas = map[string]*Usage{}
+	s.mu.Unlock()
+	if err := s.flush(true); err != nil {
+		s.Thaw()
+		return err
+	}
+	return nil
+}
+
+// Thaw writes the file of a frozen store again, once the process taking it
+// over failed. The deltas are part of the usage written.
+func (s *Store) Thaw() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frozen = false
+	s.deltas = nil
+}
+
+// flush writes the store to its file, even if frozen when force is set. The
+// caller must hold s.flushMu.
+func (s *Store) flush(force bool) error {
+	s.mu.Lock()
+	if s.version == s.flushed || s.frozen && !force {
+		s.mu.Unlock()
+		return nil
+	}
+	version := s.version
+	list := make([]*Usage, 0, len(s.usage))
+	for _, u := range s.usage {
+		copied := *u
+		list = append(list, &copied)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Agent < list[j].Agent })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// replace the file at once, so that a crash never leaves half of it
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return err
+	}
+
+	// changes made meanwhile are left for the next flush
+	s.mu.Lock()
+	s.flushed = version
+	s.mu.Unlock()
+	return nil
+}
+
+// current returns the usage of agent, with the counters of a past day or
+// month reset. The caller must hold s.mu.
+func (s *Store) current(agent string) *Usage {
+	return current(s.usage, agent)
+}
+
+// current returns the usage of agent in m, with the counters of a past day
+// or month reset.
+func current(m map[string]*Usage, agent string) *Usage {
+	now := time.Now()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+
+	u, ok := m[agent]
+	if !ok {
+		u = &Usage{Agent: agent, Day: day, Month: month}
+		m[agent] = u
+	}
+	if u.Day != day {
+		u.Day, u.DayBytes = day, Counter{}
+	}
+	if u.Month != month {
+		u.Month, u.MonthBytes = month, Counter{}
+	}
+	return u
+}
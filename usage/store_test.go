@@ -0,0 +1,181 @@
+package usage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorePersisted(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+
+	s, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.List(); len(got) != 0 {
+		t.Fatalf("List of a new store = %v, want none", got)
+	}
+	s.Add("laptop-01", 100, 1000)
+	s.Add("laptop-01", 10, 0)
+	s.Add("laptop-02", 1, 2)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// counted after the flush, lost by the restart
+	s.Add("laptop-02", 1, 2)
+
+	restarted, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		agent string
+		want  Counter
+	}{
+		{"laptop-01", Counter{Up: 110, Down: 1000}},
+		{"laptop-02", Counter{Up: 1, Down: 2}},
+		{"laptop-03", Counter{}},
+	}
+	for _, tt := range tests {
+		u := restarted.Get(tt.agent)
+		if u.DayBytes != tt.want || u.MonthBytes != tt.want {
+			t.Errorf("Get(%q) = %+v, want %+v in the day and month", tt.agent, u, tt.want)
+		}
+	}
+
+	// counting goes on from the persisted usage
+	restarted.Add("laptop-01", 0, 1)
+	if err := restarted.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := again.Get("laptop-01").MonthBytes; got != (Counter{Up: 110, Down: 1001}) {
+		t.Errorf("usage after the second restart = %+v", got)
+	}
+}
+
+func TestStorePastPeriods(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	now := time.Now()
+	data := `[
+  {"agent": "yesterday", "day": "2000-01-01", "day_bytes": {"up": 5, "down": 5}, "month": "` + now.Format("2006-01") + `", "month_bytes": {"up": 50, "down": 50}},
+  {"agent": "last-month", "day": "2000-01-01", "day_bytes": {"up": 5, "down": 5}, "month": "2000-01", "month_bytes": {"up": 50, "down": 50}}
+]`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := s.Get("yesterday"); u.DayBytes.Total() != 0 || u.MonthBytes.Total() != 100 {
+		t.Errorf("Get(yesterday) = %+v, want the day reset and the month kept", u)
+	}
+	if u := s.Get("last-month"); u.DayBytes.Total() != 0 || u.MonthBytes.Total() != 0 {
+		t.Errorf("Get(last-month) = %+v, want both reset", u)
+	}
+}
+
+func TestStoreOpenInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	if err := os.WriteFile(file, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(file); err == nil {
+		t.Fatal("Open succeeded with an invalid file")
+	}
+}
+
+func TestStoreFrozen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+
+	s, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add("laptop-01", 10, 10)
+	if err := s.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new process loads the usage once frozen
+	taken, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := taken.Get("laptop-01").DayBytes; got != (Counter{Up: 10, Down: 10}) {
+		t.Fatalf("usage loaded after the freeze = %+v", got)
+	}
+
+	// the frozen store counts the draining traffic apart, and no longer
+	// writes the file
+	s.Add("laptop-01", 1, 2)
+	s.Add("laptop-02", 3, 4)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, _ := Open(file); reopened.Get("laptop-02").DayBytes.Total() != 0 {
+		t.Fatal("frozen store written")
+	}
+	if got := s.Get("laptop-01").DayBytes; got != (Counter{Up: 11, Down: 12}) {
+		t.Fatalf("usage of the frozen store = %+v", got)
+	}
+	deltas := s.Deltas()
+	if len(deltas) != 2 || deltas[0].DayBytes != (Counter{Up: 1, Down: 2}) || deltas[1].MonthBytes != (Counter{Up: 3, Down: 4}) {
+		t.Fatalf("Deltas = %+v, want the traffic counted since the freeze", deltas)
+	}
+
+	// and the new process adds them up to its own
+	taken.Add("laptop-01", 100, 0)
+	taken.Merge(deltas)
+	taken.Merge([]Usage{{Agent: "laptop-03", Day: "2000-01-01", DayBytes: Counter{Up: 1}, Month: "2000-01", MonthBytes: Counter{Up: 1}}})
+	tests := []struct {
+		agent string
+		want  Counter
+	}{
+		{"laptop-01", Counter{Up: 111, Down: 12}},
+		{"laptop-02", Counter{Up: 3, Down: 4}},
+		{"laptop-03", Counter{}},
+	}
+	for _, tt := range tests {
+		if u := taken.Get(tt.agent); u.DayBytes != tt.want || u.MonthBytes != tt.want {
+			t.Errorf("Get(%q) after the merge = %+v, want %+v", tt.agent, u, tt.want)
+		}
+	}
+}
+
+func TestStoreThawed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+
+	s, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	s.Add("laptop-01", 1, 2)
+
+	// the upgrade failed, the store writes its file again, along with the
+	// traffic counted while frozen
+	s.Thaw()
+	if deltas := s.Deltas(); len(deltas) != 0 {
+		t.Fatalf("Deltas of a thawed store = %+v", deltas)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Get("laptop-01").DayBytes; got != (Counter{Up: 1, Down: 2}) {
+		t.Fatalf("usage written after the thaw = %+v", got)
+	}
+}